@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apt and dpkg both take this lock for as long as they're installing anything. Right after boot it's usually
+// unattended-upgrades that has it.
+const dpkgLockPath = "/var/lib/dpkg/lock-frontend"
+
+// Options every apt-get run gets, so nothing ever stops to ask a question over ssh. confdef and confold keep config
+// files that were changed on the server instead of prompting about the package's new version of them.
+const aptGetOptions = "-y -o Dpkg::Options::=--force-confdef -o Dpkg::Options::=--force-confold"
+
+type aptPackage struct {
+	name string
+	// The full apt version, like '7.88.1-10+deb12u5'. Empty means whatever is newest, and then whatever is installed.
+	version string
+	// Answers to the package's install questions, in 'debconf-set-selections' format. They're set before it's installed.
+	debconf []string
+}
+
+func (p aptPackage) String() string {
+	if p.version == "" {
+		return p.name
+	}
+	return fmt.Sprintf("%v=%v", p.name, p.version)
+}
+
+// Parses packages written like 'jq' or 'jq=1.6-2.1', the same way 'apt-get install' takes them.
+func parseAptPackages(specs []string) []aptPackage {
+	var packages []aptPackage
+	for _, spec := range specs {
+		name, version, _ := strings.Cut(strings.TrimSpace(spec), "=")
+		if name == "" || strings.ContainsAny(name, " /'\"") || strings.ContainsAny(version, " /'\"") {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' is not a package. It should look like 'jq' or 'jq=1.6-2.1'.", spec))
+		}
+		packages = append(packages, aptPackage{name: name, version: version})
+	}
+	return packages
+}
+
+// Adds the extra packages to the base ones. A package that's in both is installed once, at the extra's version.
+func mergeAptPackages(base []aptPackage, extra []aptPackage) []aptPackage {
+	merged := append([]aptPackage{}, base...)
+	for _, p := range extra {
+		found := false
+		for i := range merged {
+			if merged[i].name == p.name {
+				merged[i].version = p.version
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+func installedPackageVersion(client *simplessh.Client, packageName string) (string, bool) {
+	out, err := client.Exec(fmt.Sprintf("dpkg-query -W -f='${Status} ${Version}' %v", packageName))
+	if err != nil || !strings.HasPrefix(string(out), "install ok installed ") {
+		return "", false
+	}
+	return strings.TrimPrefix(string(out), "install ok installed "), true
+}
+
+func packageInstalled(client *simplessh.Client, packageName string) bool {
+	_, installed := installedPackageVersion(client, packageName)
+	return installed
+}
+
+// Returns the packages that aren't installed, or are installed at a different version than they're pinned to.
+func missingPackages(client *simplessh.Client, packages []aptPackage) []aptPackage {
+	var missing []aptPackage
+	for _, p := range packages {
+		version, installed := installedPackageVersion(client, p.name)
+		if !installed || (p.version != "" && version != p.version) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// The names of the processes that have the dpkg lock open.
+func dpkgLockHolders(client *simplessh.Client) []string {
+	out, err := client.Exec(fmt.Sprintf("for pid in $(find /proc/[0-9]*/fd -lname %v 2>/dev/null | cut -d/ -f3 | sort -u); do cat /proc/$pid/comm 2>/dev/null; done; true", dpkgLockPath))
+	AssertNoErr(err, "Could not check if something else is using apt.")
+
+	var holders []string
+	for _, name := range strings.Fields(string(out)) {
+		if !containsString(holders, name) {
+			holders = append(holders, name)
+		}
+	}
+	sort.Strings(holders)
+	return holders
+}
+
+// Waits for whatever else is using apt to finish, counting down until '--dpkg-lock-timeout' runs out.
+func waitForDpkgLock(client *simplessh.Client) {
+	timeout := time.Duration(*Flags.Setup.DpkgLockTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+
+	waited := false
+	for {
+		holders := dpkgLockHolders(client)
+		if len(holders) == 0 {
+			break
+		}
+
+		left := time.Until(deadline).Round(time.Second)
+		if left <= 0 {
+			fmt.Println()
+			PrintMessageAndQuit(fmt.Sprintf("%v still had apt locked after %v. Try again once it's done, or give '--dpkg-lock-timeout' more time.", strings.Join(holders, ", "), timeout))
+		}
+		// The '\r' writes over the last countdown instead of printing a new line every time.
+		fmt.Printf("\r%vWaiting for %v to finish with apt, %v left...  ", LINE_PADDING, strings.Join(holders, ", "), left)
+		waited = true
+		time.Sleep(2 * time.Second)
+	}
+
+	if waited {
+		fmt.Println()
+		PrintSubStepInformation(fmt.Sprintf("%vapt is free now.", LINE_PADDING))
+	}
+}
+
+// Runs apt-get once nothing else is using it. The lock is waited on again by apt-get itself, for the small window
+// where something else can grab it between the check and the run.
+func aptGet(client *simplessh.Client, args string) {
+	waitForDpkgLock(client)
+	SSHCommand(client, fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get %v -o DPkg::Lock::Timeout=60 %v %v", aptGetOptions, aptSourceOptions(), args))
+}
+
+// Installs all of the packages in one apt transaction, so apt only has to work out dependencies and run triggers once.
+func installPackages(client *simplessh.Client, packages []aptPackage, extraArgs string) {
+	var names []string
+	for _, p := range packages {
+		for _, selection := range p.debconf {
+			SSHCommand(client, fmt.Sprintf("echo '%v' | debconf-set-selections", selection))
+		}
+		names = append(names, p.String())
+	}
+	aptGet(client, strings.Join(append([]string{"install", "--no-install-recommends", extraArgs}, names...), " "))
+}
+
+func installPackagesStep(client *simplessh.Client, packages []aptPackage) Step {
+	var inputs []string
+	for _, p := range packages {
+		inputs = append(inputs, p.String())
+		inputs = append(inputs, p.debconf...)
+	}
+
+	return Step{
+		Name:        "install-packages",
+		Description: "Installing packages",
+		DependsOn:   []string{"update-apt"},
+		Inputs:      inputs,
+		Check: func() bool {
+			return len(missingPackages(client, packages)) > 0
+		},
+		Apply: func() {
+			// Only the missing ones are installed. Installing one that's already there could upgrade it, and break
+			// whatever depends on the version that's running. See https://serverfault.com/a/670688
+			missing := missingPackages(client, packages)
+			var names []string
+			for _, p := range missing {
+				names = append(names, p.String())
+			}
+			PrintSubStepInformation(fmt.Sprintf("%vThese need to be installed: %v", LINE_PADDING, strings.Join(names, ", ")))
+			// A pinned version can be older than the one that's installed.
+			installPackages(client, missing, "--allow-downgrades")
+		},
+	}
+}
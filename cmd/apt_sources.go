@@ -0,0 +1,546 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"net/url"
+	"strings"
+)
+
+// apt only reads files in apt.conf.d in order, so this goes right before unattended-upgrades' 52snakeplant.
+const aptProxyConfPath = "/etc/apt/apt.conf.d/51snakeplant-proxy"
+
+// What gets changed in the OS's own apt sources. Third party repositories, like Docker's, are in files of their own,
+// and are left alone.
+type aptSourcesOptions struct {
+	// Like 'backports' or 'noble-proposed'. A suite without a '-' in it is a pocket of the OS's release.
+	disableSuites []string
+	enableSuites  []string
+	// Like 'universe' or 'non-free-firmware'.
+	disableComponents []string
+	enableComponents  []string
+	// Replaces the archive the OS's packages come from. Security updates keep coming from the OS's security archive,
+	// since mirrors can be hours behind it.
+	mirror string
+}
+
+func newAptSourcesOptions() aptSourcesOptions {
+	options := aptSourcesOptions{
+		enableSuites:      *Flags.Setup.EnableSuites,
+		enableComponents:  *Flags.Setup.EnableComponents,
+		disableComponents: *Flags.Setup.DisableComponents,
+		mirror:            strings.TrimSuffix(*Flags.Setup.AptMirror, "/"),
+	}
+	// Enabling a suite wins over disabling it, so backports can be turned back on without repeating the other defaults.
+	for _, suite := range *Flags.Setup.DisableSuites {
+		if !containsString(options.enableSuites, suite) {
+			options.disableSuites = append(options.disableSuites, suite)
+		}
+	}
+	for _, component := range options.enableComponents {
+		if containsString(options.disableComponents, component) {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' can't be in both '--enable-components' and '--disable-components'.", component))
+		}
+	}
+	if options.mirror != "" {
+		parseAptURL(options.mirror, "--apt-mirror")
+	}
+	return options
+}
+
+func parseAptURL(rawURL string, flagName string) *url.URL {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || strings.ContainsAny(rawURL, " \"'") {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' should be a url like 'http://mirror.example.com/ubuntu'. It was '%v'.", flagName, rawURL))
+	}
+	return parsed
+}
+
+func (o aptSourcesOptions) inputs() []string {
+	return []string{
+		strings.Join(o.disableSuites, ","),
+		strings.Join(o.enableSuites, ","),
+		strings.Join(o.disableComponents, ","),
+		strings.Join(o.enableComponents, ","),
+		o.mirror,
+	}
+}
+
+// 'backports' on noble is 'noble-backports'.
+func fullSuiteName(codename string, suite string) string {
+	if suite == codename || strings.Contains(suite, "-") {
+		return suite
+	}
+	return fmt.Sprintf("%v-%v", codename, suite)
+}
+
+func fullSuiteNames(codename string, suites []string) []string {
+	var names []string
+	for _, suite := range suites {
+		names = append(names, fullSuiteName(codename, suite))
+	}
+	return names
+}
+
+// Every component Ubuntu and Debian have.
+var osComponents = []string{"main", "restricted", "universe", "multiverse", "contrib", "non-free", "non-free-firmware"}
+
+// Whether the suite belongs to the OS's release.
+func isReleaseSuite(codename string, suite string) bool {
+	return suite == codename || strings.HasPrefix(suite, codename+"-")
+}
+
+// Whether the entry is for the OS's own archive, instead of some other repository that happens to be in the same
+// file. Third party repositories often use the OS's codename as their suite too, like Docker's 'jammy stable', so
+// they're told apart by their components.
+func isOSSource(codename string, suites []string, components []string) bool {
+	for _, suite := range suites {
+		if !isReleaseSuite(codename, suite) {
+			return false
+		}
+	}
+	for _, component := range components {
+		if !containsString(osComponents, component) {
+			return false
+		}
+	}
+	return len(suites) > 0 && len(components) > 0
+}
+
+func isSecuritySuite(suite string) bool {
+	return strings.HasSuffix(suite, "-security")
+}
+
+// Takes out the components in remove, and adds the ones in add that aren't there yet.
+func editComponents(components []string, remove []string, add []string) []string {
+	var edited []string
+	for _, component := range components {
+		if !containsString(remove, component) {
+			edited = append(edited, component)
+		}
+	}
+	for _, component := range add {
+		if !containsString(edited, component) {
+			edited = append(edited, component)
+		}
+	}
+	return edited
+}
+
+// Returns the apt sources file content with the options applied. Lines that don't need to change are kept exactly as
+// they are, comments included.
+func (o aptSourcesOptions) render(sources aptSourcesFile, codename string) func(current string) string {
+	return func(current string) string {
+		if sources.deb822 {
+			return o.renderDeb822(current, codename)
+		}
+		return o.renderOneLine(current, codename)
+	}
+}
+
+// What snakeplant puts in front of one-line entries it turns off, so it knows which ones it can turn back on.
+const disabledSourcePrefix = "# Disabled by snakeplant: "
+
+// One-line entries look like 'deb [options] uri suite components... # comment'.
+type oneLineSource struct {
+	kind       string
+	options    string
+	uri        string
+	suite      string
+	components []string
+	comment    string
+}
+
+func parseOneLineSource(line string) (oneLineSource, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || (fields[0] != "deb" && fields[0] != "deb-src") {
+		return oneLineSource{}, false
+	}
+	source := oneLineSource{kind: fields[0]}
+	rest := fields[1:]
+
+	// Options can have spaces in them, like '[arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg]'.
+	if len(rest) > 0 && strings.HasPrefix(rest[0], "[") {
+		var options []string
+		for len(rest) > 0 {
+			options = append(options, rest[0])
+			rest = rest[1:]
+			if strings.HasSuffix(options[len(options)-1], "]") {
+				break
+			}
+		}
+		source.options = strings.Join(options, " ")
+	}
+
+	if len(rest) < 2 {
+		return oneLineSource{}, false
+	}
+	source.uri = rest[0]
+	source.suite = rest[1]
+	for i, field := range rest[2:] {
+		if strings.HasPrefix(field, "#") {
+			source.comment = strings.Join(rest[2+i:], " ")
+			break
+		}
+		source.components = append(source.components, field)
+	}
+	return source, true
+}
+
+func (s oneLineSource) String() string {
+	fields := []string{s.kind}
+	if s.options != "" {
+		fields = append(fields, s.options)
+	}
+	fields = append(fields, s.uri, s.suite)
+	fields = append(fields, s.components...)
+	if s.comment != "" {
+		fields = append(fields, s.comment)
+	}
+	return strings.Join(fields, " ")
+}
+
+func (o aptSourcesOptions) renderOneLine(current string, codename string) string {
+	disabled := fullSuiteNames(codename, o.disableSuites)
+	enabled := fullSuiteNames(codename, o.enableSuites)
+
+	lines := splitLines(current)
+	active := map[string]bool{}
+	for i, line := range lines {
+		// Sources snakeplant turned off before come back once their suite is enabled.
+		wasDisabled := strings.HasPrefix(line, disabledSourcePrefix)
+		source, ok := parseOneLineSource(strings.TrimPrefix(line, disabledSourcePrefix))
+		if !ok || (wasDisabled && !containsString(enabled, source.suite)) {
+			continue
+		}
+		if !isOSSource(codename, []string{source.suite}, source.components) {
+			if !wasDisabled {
+				active[source.suite] = true
+			}
+			continue
+		}
+
+		if containsString(disabled, source.suite) {
+			lines[i] = disabledSourcePrefix + line
+			continue
+		}
+
+		edited := o.editOneLine(source, codename)
+		if wasDisabled || edited.String() != source.String() {
+			lines[i] = edited.String()
+		}
+		active[source.suite] = true
+	}
+
+	// Suites that still aren't there are added after the release's main entries, with the same options and components.
+	for _, suite := range enabled {
+		if active[suite] || containsString(disabled, suite) {
+			continue
+		}
+		found := false
+		for i := 0; i < len(lines); i++ {
+			source, ok := parseOneLineSource(lines[i])
+			if !ok || source.suite != codename || !isOSSource(codename, []string{source.suite}, source.components) {
+				continue
+			}
+			source = o.editOneLine(source, codename)
+			source.suite = suite
+			source.comment = ""
+			lines = append(lines[:i+1], append([]string{source.String()}, lines[i+1:]...)...)
+			i++
+			found = true
+		}
+		if !found {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' can't be turned on, since there's no '%v' entry in the apt sources to copy it from.", suite, codename))
+		}
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (o aptSourcesOptions) editOneLine(source oneLineSource, codename string) oneLineSource {
+	source.components = editComponents(source.components, o.disableComponents, o.enableComponents)
+	if len(source.components) == 0 {
+		PrintMessageAndQuit(fmt.Sprintf("'--disable-components' would leave '%v' without any components.", source.suite))
+	}
+	if o.mirror != "" && !isSecuritySuite(source.suite) {
+		source.uri = o.mirror
+	}
+	return source
+}
+
+// A 'Key: value' field in a deb822 stanza. Values can carry on over lines that start with a space.
+type deb822Field struct {
+	key   string
+	value string
+	// The lines the field is on, end not included.
+	start, end int
+}
+
+type deb822Stanza struct {
+	fields []deb822Field
+	// The line after the stanza's last one.
+	end int
+}
+
+func (s deb822Stanza) field(key string) (deb822Field, bool) {
+	for _, f := range s.fields {
+		if strings.EqualFold(f.key, key) {
+			return f, true
+		}
+	}
+	return deb822Field{}, false
+}
+
+func (s deb822Stanza) values(key string) []string {
+	f, _ := s.field(key)
+	return strings.Fields(f.value)
+}
+
+func parseDeb822(lines []string) []deb822Stanza {
+	var stanzas []deb822Stanza
+	var current *deb822Stanza
+	for i, line := range lines {
+		switch {
+		case strings.TrimSpace(line) == "":
+			if current != nil {
+				stanzas = append(stanzas, *current)
+				current = nil
+			}
+		case strings.HasPrefix(line, "#"):
+			// Comments can be anywhere, even in the middle of a stanza.
+		case line[0] == ' ' || line[0] == '\t':
+			if current != nil && len(current.fields) > 0 {
+				last := &current.fields[len(current.fields)-1]
+				last.value += " " + strings.TrimSpace(line)
+				last.end = i + 1
+				current.end = i + 1
+			}
+		default:
+			key, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			if current == nil {
+				current = &deb822Stanza{}
+			}
+			current.fields = append(current.fields, deb822Field{key: strings.TrimSpace(key), value: strings.TrimSpace(value), start: i, end: i + 1})
+			current.end = i + 1
+		}
+	}
+	if current != nil {
+		stanzas = append(stanzas, *current)
+	}
+	return stanzas
+}
+
+func (o aptSourcesOptions) renderDeb822(current string, codename string) string {
+	disabled := fullSuiteNames(codename, o.disableSuites)
+	enabled := fullSuiteNames(codename, o.enableSuites)
+
+	lines := splitLines(current)
+	stanzas := parseDeb822(lines)
+
+	// Every original line is replaced by these, so fields can be rewritten, added or dropped without moving anything
+	// else around.
+	replacements := map[int][]string{}
+	setField := func(stanza deb822Stanza, key string, value string) {
+		line := fmt.Sprintf("%v: %v", key, value)
+		if f, ok := stanza.field(key); ok {
+			if f.value == value {
+				return
+			}
+			replacements[f.start] = []string{line}
+			for i := f.start + 1; i < f.end; i++ {
+				replacements[i] = nil
+			}
+			return
+		}
+		last := stanza.end - 1
+		if existing, ok := replacements[last]; ok {
+			replacements[last] = append(existing, line)
+		} else {
+			replacements[last] = []string{lines[last], line}
+		}
+	}
+
+	type edit struct {
+		stanza  deb822Stanza
+		suites  []string
+		enabled bool
+	}
+	var edits []*edit
+	active := map[string]bool{}
+	var main *edit
+	for _, stanza := range stanzas {
+		types := stanza.values("Types")
+		suites := stanza.values("Suites")
+		if (!containsString(types, "deb") && !containsString(types, "deb-src")) || len(suites) == 0 {
+			continue
+		}
+		wasEnabled := !strings.EqualFold(strings.Join(stanza.values("Enabled"), ""), "no")
+		if !isOSSource(codename, suites, stanza.values("Components")) {
+			if wasEnabled {
+				for _, suite := range suites {
+					active[suite] = true
+				}
+			}
+			continue
+		}
+
+		e := &edit{stanza: stanza, enabled: wasEnabled}
+		for _, suite := range suites {
+			if !containsString(disabled, suite) {
+				e.suites = append(e.suites, suite)
+			}
+			// A stanza snakeplant turned off comes back once one of its suites is enabled.
+			if containsString(enabled, suite) {
+				e.enabled = true
+			}
+		}
+		if len(e.suites) == 0 {
+			e.enabled = false
+		}
+		if e.enabled {
+			for _, suite := range e.suites {
+				active[suite] = true
+			}
+			if main == nil && containsString(e.suites, codename) && containsString(types, "deb") {
+				main = e
+			}
+		}
+		edits = append(edits, e)
+	}
+
+	for _, suite := range enabled {
+		if active[suite] || containsString(disabled, suite) {
+			continue
+		}
+		if main == nil {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' can't be turned on, since there's no stanza with '%v' in it in the apt sources to add it to.", suite, codename))
+		}
+		main.suites = append(main.suites, suite)
+		active[suite] = true
+	}
+
+	for _, e := range edits {
+		if !e.enabled {
+			// The suites are left alone, so the stanza still makes sense if someone turns it back on by hand.
+			setField(e.stanza, "Enabled", "no")
+			continue
+		}
+		if _, ok := e.stanza.field("Enabled"); ok {
+			setField(e.stanza, "Enabled", "yes")
+		}
+		setField(e.stanza, "Suites", strings.Join(e.suites, " "))
+
+		components := editComponents(e.stanza.values("Components"), o.disableComponents, o.enableComponents)
+		if len(components) == 0 {
+			PrintMessageAndQuit(fmt.Sprintf("'--disable-components' would leave '%v' without any components.", strings.Join(e.suites, " ")))
+		}
+		setField(e.stanza, "Components", strings.Join(components, " "))
+
+		security := false
+		for _, suite := range e.suites {
+			security = security || isSecuritySuite(suite)
+		}
+		if o.mirror != "" && !security {
+			setField(e.stanza, "URIs", o.mirror)
+		}
+	}
+
+	var rendered []string
+	for i, line := range lines {
+		if replacement, ok := replacements[i]; ok {
+			rendered = append(rendered, replacement...)
+			continue
+		}
+		rendered = append(rendered, line)
+	}
+	if len(rendered) == 0 {
+		return ""
+	}
+	return strings.Join(rendered, "\n") + "\n"
+}
+
+// Newer Debian images only have the deb822 file, and older ones only have sources.list, so the first one of the
+// platform's files that's actually there is used.
+func detectAptSources(client *simplessh.Client, target platform) aptSourcesFile {
+	for _, sources := range target.aptSourcesFiles {
+		if _, exists := readRemoteFile(client, sources.path); exists {
+			return sources
+		}
+	}
+	var paths []string
+	for _, sources := range target.aptSourcesFiles {
+		paths = append(paths, sources.path)
+	}
+	PrintMessageAndQuit(fmt.Sprintf("Could not find the apt sources. They should be in one of: %v.", strings.Join(paths, ", ")))
+	return aptSourcesFile{}
+}
+
+func aptProxyConf(proxy string) string {
+	if proxy == "" {
+		return ""
+	}
+	return fmt.Sprintf(`// Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs.
+Acquire::http::Proxy "%v";
+Acquire::https::Proxy "%v";
+`, proxy, proxy)
+}
+
+func aptSourcesSteps(client *simplessh.Client, target platform, options aptSourcesOptions, proxy string) []Step {
+	sources := managedFile{
+		path:   target.aptSources.path,
+		owner:  "root:root",
+		mode:   0644,
+		render: options.render(target.aptSources, target.codename),
+	}
+	proxyFile := managedFile{
+		path:  aptProxyConfPath,
+		owner: "root:root",
+		mode:  0644,
+		render: func(string) string {
+			return aptProxyConf(proxy)
+		},
+		validate: func(client *simplessh.Client, stagedPath string) {
+			out, err := client.Exec(fmt.Sprintf("apt-config -c %v dump", stagedPath))
+			dumped := parseAptConfigDump(string(out))
+			if err != nil || strings.Join(dumped["Acquire::http::Proxy"], "") != proxy {
+				PrintMessageAndQuit(fmt.Sprintf("apt doesn't read the new proxy settings the way snakeplant wrote them:\n%v%v", LINE_PADDING, strings.TrimSpace(string(out))))
+			}
+		},
+	}
+
+	proxyStep := managedFileStep(client, "configure-apt-proxy", "Configuring apt's proxy", proxyFile, proxy)
+	if proxy == "" {
+		// Without '--apt-proxy', a proxy snakeplant set up before is taken out. Anyone else's proxy settings are in
+		// other files, and are left alone.
+		proxyStep = Step{
+			Name:        "configure-apt-proxy",
+			Description: "Removing apt's proxy",
+			Inputs:      []string{proxy},
+			Check: func() bool {
+				_, exists := readRemoteFile(client, aptProxyConfPath)
+				return exists
+			},
+			Diff: func() string {
+				current, _ := readRemoteFile(client, aptProxyConfPath)
+				return unifiedDiff(aptProxyConfPath+" (before)", aptProxyConfPath+" (after)", current, "")
+			},
+			Apply: func() {
+				current, _ := readRemoteFile(client, aptProxyConfPath)
+				SSHCommand(client, fmt.Sprintf("rm -f %v", aptProxyConfPath))
+				printUnifiedDiff(unifiedDiff(aptProxyConfPath+" (before)", aptProxyConfPath+" (after)", current, ""))
+			},
+		}
+	}
+
+	return []Step{
+		managedFileStep(client, "configure-apt-sources", "Configuring apt sources", sources, append(options.inputs(), target.codename, fmt.Sprint(target.aptSources.deb822))...),
+		proxyStep,
+	}
+}
@@ -0,0 +1,317 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOneLineSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   oneLineSource
+		wantOk bool
+	}{
+		{
+			name:   "plain",
+			line:   "deb http://archive.ubuntu.com/ubuntu jammy main restricted",
+			want:   oneLineSource{kind: "deb", uri: "http://archive.ubuntu.com/ubuntu", suite: "jammy", components: []string{"main", "restricted"}},
+			wantOk: true,
+		},
+		{
+			name:   "options with spaces",
+			line:   "deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy main",
+			want:   oneLineSource{kind: "deb", options: "[arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg]", uri: "http://archive.ubuntu.com/ubuntu", suite: "jammy", components: []string{"main"}},
+			wantOk: true,
+		},
+		{
+			name:   "trailing comment",
+			line:   "deb-src http://deb.debian.org/debian bookworm main contrib # for building",
+			want:   oneLineSource{kind: "deb-src", uri: "http://deb.debian.org/debian", suite: "bookworm", components: []string{"main", "contrib"}, comment: "# for building"},
+			wantOk: true,
+		},
+		{
+			name: "comment",
+			line: "# deb http://archive.ubuntu.com/ubuntu jammy main",
+		},
+		{
+			name: "blank",
+			line: "",
+		},
+		{
+			name: "no suite",
+			line: "deb [arch=amd64] http://archive.ubuntu.com/ubuntu",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseOneLineSource(test.line)
+			if ok != test.wantOk || !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseOneLineSource(%q) = %#v, %v, want %#v, %v", test.line, got, ok, test.want, test.wantOk)
+			}
+			if ok && got.String() != test.line {
+				t.Errorf("String() = %q, want %q", got.String(), test.line)
+			}
+		})
+	}
+}
+
+const jammySources = `# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy main restricted # the release
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-updates main restricted
+# deb http://archive.ubuntu.com/ubuntu jammy-proposed main
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-backports main restricted
+deb http://security.ubuntu.com/ubuntu jammy-security main restricted
+deb [arch=amd64] https://download.docker.com/linux/ubuntu jammy stable
+`
+
+func TestRenderOneLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		options aptSourcesOptions
+		current string
+		want    string
+	}{
+		{
+			name:    "nothing to change",
+			current: jammySources,
+			want:    jammySources,
+		},
+		{
+			name:    "empty",
+			current: "",
+			want:    "",
+		},
+		{
+			name:    "disable a suite",
+			options: aptSourcesOptions{disableSuites: []string{"backports"}},
+			current: jammySources,
+			want: `# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy main restricted # the release
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-updates main restricted
+# deb http://archive.ubuntu.com/ubuntu jammy-proposed main
+# Disabled by snakeplant: deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-backports main restricted
+deb http://security.ubuntu.com/ubuntu jammy-security main restricted
+deb [arch=amd64] https://download.docker.com/linux/ubuntu jammy stable
+`,
+		},
+		{
+			name:    "disabling twice doesn't disable again",
+			options: aptSourcesOptions{disableSuites: []string{"backports"}},
+			current: "# Disabled by snakeplant: deb http://archive.ubuntu.com/ubuntu jammy-backports main\n",
+			want:    "# Disabled by snakeplant: deb http://archive.ubuntu.com/ubuntu jammy-backports main\n",
+		},
+		{
+			name:    "enable a suite snakeplant disabled",
+			options: aptSourcesOptions{enableSuites: []string{"backports"}},
+			current: "deb http://archive.ubuntu.com/ubuntu jammy main\n# Disabled by snakeplant: deb [arch=amd64] http://archive.ubuntu.com/ubuntu jammy-backports main\n",
+			want:    "deb http://archive.ubuntu.com/ubuntu jammy main\ndeb [arch=amd64] http://archive.ubuntu.com/ubuntu jammy-backports main\n",
+		},
+		{
+			name:    "enable a suite that isn't there",
+			options: aptSourcesOptions{enableSuites: []string{"proposed"}},
+			current: jammySources,
+			want: `# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy main restricted # the release
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-proposed main restricted
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-updates main restricted
+# deb http://archive.ubuntu.com/ubuntu jammy-proposed main
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://archive.ubuntu.com/ubuntu jammy-backports main restricted
+deb http://security.ubuntu.com/ubuntu jammy-security main restricted
+deb [arch=amd64] https://download.docker.com/linux/ubuntu jammy stable
+`,
+		},
+		{
+			name:    "components and mirror",
+			options: aptSourcesOptions{enableComponents: []string{"universe"}, disableComponents: []string{"restricted"}, mirror: "http://mirror.example.com/ubuntu"},
+			current: jammySources,
+			want: `# See http://help.ubuntu.com/community/UpgradeNotes for how to upgrade to
+# newer versions of the distribution.
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://mirror.example.com/ubuntu jammy main universe # the release
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://mirror.example.com/ubuntu jammy-updates main universe
+# deb http://archive.ubuntu.com/ubuntu jammy-proposed main
+deb [arch=amd64 signed-by=/usr/share/keyrings/ubuntu.gpg] http://mirror.example.com/ubuntu jammy-backports main universe
+deb http://security.ubuntu.com/ubuntu jammy-security main universe
+deb [arch=amd64] https://download.docker.com/linux/ubuntu jammy stable
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.options.render(aptSourcesFile{}, "jammy")(test.current); got != test.want {
+				t.Errorf("rendered:\n%v\nwant:\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+const nobleSources = `# Ubuntu sources have moved to /etc/apt/sources.list.d/ubuntu.sources
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: noble noble-updates noble-backports
+Components: main restricted universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+Types: deb
+# Security updates come straight from Ubuntu.
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main restricted
+  universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`
+
+func TestParseDeb822(t *testing.T) {
+	stanzas := parseDeb822(splitLines(nobleSources))
+	if len(stanzas) != 2 {
+		t.Fatalf("got %v stanzas, want 2", len(stanzas))
+	}
+
+	tests := []struct {
+		stanza int
+		key    string
+		want   []string
+		start  int
+		end    int
+	}{
+		{stanza: 0, key: "Types", want: []string{"deb"}, start: 1, end: 2},
+		{stanza: 0, key: "Suites", want: []string{"noble", "noble-updates", "noble-backports"}, start: 3, end: 4},
+		{stanza: 0, key: "signed-by", want: []string{"/usr/share/keyrings/ubuntu-archive-keyring.gpg"}, start: 5, end: 6},
+		{stanza: 1, key: "URIs", want: []string{"http://security.ubuntu.com/ubuntu/"}, start: 9, end: 10},
+		{stanza: 1, key: "Components", want: []string{"main", "restricted", "universe", "multiverse"}, start: 11, end: 13},
+	}
+	for _, test := range tests {
+		stanza := stanzas[test.stanza]
+		f, ok := stanza.field(test.key)
+		if !ok {
+			t.Errorf("stanza %v has no %v field", test.stanza, test.key)
+			continue
+		}
+		if got := stanza.values(test.key); !reflect.DeepEqual(got, test.want) || f.start != test.start || f.end != test.end {
+			t.Errorf("stanza %v %v = %q on lines %v-%v, want %q on lines %v-%v", test.stanza, test.key, got, f.start, f.end, test.want, test.start, test.end)
+		}
+	}
+	if stanzas[0].end != 6 || stanzas[1].end != 14 {
+		t.Errorf("stanzas end at %v and %v, want 6 and 14", stanzas[0].end, stanzas[1].end)
+	}
+}
+
+func TestRenderDeb822(t *testing.T) {
+	tests := []struct {
+		name    string
+		options aptSourcesOptions
+		current string
+		want    string
+	}{
+		{
+			name:    "nothing to change",
+			current: nobleSources,
+			want:    nobleSources,
+		},
+		{
+			name:    "disable one suite of several",
+			options: aptSourcesOptions{disableSuites: []string{"backports"}},
+			current: nobleSources,
+			want: `# Ubuntu sources have moved to /etc/apt/sources.list.d/ubuntu.sources
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: noble noble-updates
+Components: main restricted universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+Types: deb
+# Security updates come straight from Ubuntu.
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main restricted
+  universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`,
+		},
+		{
+			name:    "disable every suite in a stanza",
+			options: aptSourcesOptions{disableSuites: []string{"security"}},
+			current: nobleSources,
+			want: `# Ubuntu sources have moved to /etc/apt/sources.list.d/ubuntu.sources
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: noble noble-updates noble-backports
+Components: main restricted universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+Types: deb
+# Security updates come straight from Ubuntu.
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main restricted
+  universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+Enabled: no
+`,
+		},
+		{
+			name:    "enable a disabled stanza",
+			options: aptSourcesOptions{enableSuites: []string{"proposed"}},
+			current: "Types: deb\nURIs: http://archive.ubuntu.com/ubuntu/\nSuites: noble\nComponents: main\n\nTypes: deb\nURIs: http://archive.ubuntu.com/ubuntu/\nSuites: noble-proposed\nComponents: main\nEnabled: no\n",
+			want:    "Types: deb\nURIs: http://archive.ubuntu.com/ubuntu/\nSuites: noble\nComponents: main\n\nTypes: deb\nURIs: http://archive.ubuntu.com/ubuntu/\nSuites: noble-proposed\nComponents: main\nEnabled: yes\n",
+		},
+		{
+			name:    "enable a suite that isn't there",
+			options: aptSourcesOptions{enableSuites: []string{"proposed"}},
+			current: nobleSources,
+			want: `# Ubuntu sources have moved to /etc/apt/sources.list.d/ubuntu.sources
+Types: deb
+URIs: http://archive.ubuntu.com/ubuntu/
+Suites: noble noble-updates noble-backports noble-proposed
+Components: main restricted universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+Types: deb
+# Security updates come straight from Ubuntu.
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main restricted
+  universe multiverse
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`,
+		},
+		{
+			name:    "components and mirror",
+			options: aptSourcesOptions{disableComponents: []string{"multiverse"}, mirror: "http://mirror.example.com/ubuntu"},
+			current: nobleSources,
+			want: `# Ubuntu sources have moved to /etc/apt/sources.list.d/ubuntu.sources
+Types: deb
+URIs: http://mirror.example.com/ubuntu
+Suites: noble noble-updates noble-backports
+Components: main restricted universe
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+
+Types: deb
+# Security updates come straight from Ubuntu.
+URIs: http://security.ubuntu.com/ubuntu/
+Suites: noble-security
+Components: main restricted universe
+Signed-By: /usr/share/keyrings/ubuntu-archive-keyring.gpg
+`,
+		},
+		{
+			name:    "third party stanza is left alone",
+			options: aptSourcesOptions{disableSuites: []string{"noble"}},
+			current: "Types: deb\nURIs: https://download.docker.com/linux/ubuntu\nSuites: noble\nComponents: stable\n",
+			want:    "Types: deb\nURIs: https://download.docker.com/linux/ubuntu\nSuites: noble\nComponents: stable\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.options.render(aptSourcesFile{deb822: true}, "noble")(test.current); got != test.want {
+				t.Errorf("rendered:\n%v\nwant:\n%v", got, test.want)
+			}
+		})
+	}
+}
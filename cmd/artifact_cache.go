@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Where the cache is uploaded to on the server. It's laid out the same way as the local one.
+	remoteArtifactsDir = "/var/local/snakeplant/artifacts"
+	// Lists every file in the cache with its sha256, in the format 'sha256sum -c' reads.
+	artifactManifestName = "SHA256SUMS"
+	// The only apt source used while setup runs from a cache. It isn't in sources.list.d, so apt doesn't use it, and
+	// complain about it, once setup is done.
+	artifactSourcesPath = "/etc/apt/snakeplant-artifacts.list"
+)
+
+// A directory on your machine with everything setup would otherwise download from the internet:
+//
+//	SHA256SUMS
+//	pack/pack-v0.28.0-linux.tgz
+//	debs/curl_7.88.1-10+deb12u5_amd64.deb
+//	...
+type artifactCache struct {
+	dir string
+}
+
+func packCachePath(pack packArtifact) string {
+	return path.Join("pack", pack.fileName)
+}
+
+func fileSha256(filePath string) string {
+	file, err := os.Open(filePath)
+	AssertNoErr(err, fmt.Sprintf("Could not open %v.", filePath))
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	AssertNoErr(err, fmt.Sprintf("Could not read %v.", filePath))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Reads a file of 'sha256  name' lines, like SHA256SUMS or the ones Debian and pack publish.
+func readSha256Sums(filePath string) map[string]string {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return map[string]string{}
+	}
+	AssertNoErr(err, fmt.Sprintf("Could not open %v.", filePath))
+	defer file.Close()
+
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// 'sha256sum -b' puts a '*' in front of the name.
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	AssertNoErr(scanner.Err(), fmt.Sprintf("Could not read %v.", filePath))
+	return sums
+}
+
+func (c artifactCache) manifest() map[string]string {
+	return readSha256Sums(filepath.Join(c.dir, artifactManifestName))
+}
+
+func (c artifactCache) manifestContent(manifest map[string]string) string {
+	var lines []string
+	for _, name := range sortedKeys(manifest) {
+		lines = append(lines, fmt.Sprintf("%v  %v", manifest[name], name))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (c artifactCache) writeManifest(manifest map[string]string) {
+	err := os.WriteFile(filepath.Join(c.dir, artifactManifestName), []byte(c.manifestContent(manifest)), 0644)
+	AssertNoErr(err, fmt.Sprintf("Could not write the manifest of %v.", c.dir))
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Copies the file into the cache and records its hash.
+func (c artifactCache) add(name string, source string, sha string) {
+	destination := filepath.Join(c.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	AssertNoErr(err, fmt.Sprintf("Could not create %v.", filepath.Dir(destination)))
+
+	if source != destination {
+		in, err := os.Open(source)
+		AssertNoErr(err, fmt.Sprintf("Could not open %v.", source))
+		defer in.Close()
+		out, err := os.Create(destination)
+		AssertNoErr(err, fmt.Sprintf("Could not create %v.", destination))
+		_, err = io.Copy(out, in)
+		AssertNoErr(err, fmt.Sprintf("Could not copy %v into the cache.", source))
+		AssertNoErr(out.Close(), fmt.Sprintf("Could not copy %v into the cache.", source))
+	}
+
+	manifest := c.manifest()
+	manifest[name] = sha
+	c.writeManifest(manifest)
+}
+
+// Checks every file against the manifest, and pack tarballs against the checksums snakeplant knows for them too.
+// Quits on the first one that doesn't match.
+func (c artifactCache) verify() map[string]string {
+	manifest := c.manifest()
+	if len(manifest) == 0 {
+		PrintMessageAndQuit(fmt.Sprintf("%v doesn't have anything in it. Add to it with 'snakeplant cache add-pack' and 'snakeplant cache add-debs'.", c.dir))
+	}
+
+	for _, name := range sortedKeys(manifest) {
+		if sha := fileSha256(filepath.Join(c.dir, filepath.FromSlash(name))); sha != manifest[name] {
+			PrintMessageAndQuit(fmt.Sprintf("%v in %v has the sha256 '%v' instead of '%v'. It's corrupt, or someone is doing something sneaky.", name, c.dir, sha, manifest[name]))
+		}
+		if strings.HasPrefix(name, "pack/") {
+			pack, ok := findCachedPackArtifact(path.Base(name))
+			if !ok || pack.tarSha != manifest[name] {
+				PrintMessageAndQuit(fmt.Sprintf("%v in %v isn't a pack release snakeplant knows the checksums for.", name, c.dir))
+			}
+		}
+	}
+	return manifest
+}
+
+func findCachedPackArtifact(fileName string) (packArtifact, bool) {
+	for _, artifacts := range packReleases {
+		for _, artifact := range artifacts {
+			if artifact.fileName == fileName {
+				return artifact, true
+			}
+		}
+	}
+	return packArtifact{}, false
+}
+
+// Debian names package files 'name_version_arch.deb', with any ':' in the version written as '%3a'.
+func parseDebFileName(fileName string) (name string, version string, arch string, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(fileName, ".deb"), "_")
+	if !strings.HasSuffix(fileName, ".deb") || len(parts) != 3 {
+		return "", "", "", false
+	}
+	version, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", "", "", false
+	}
+	return parts[0], version, parts[2], true
+}
+
+// Downloads the url to a temp file on this machine, and returns where it is.
+func downloadLocally(downloadURL string) string {
+	fmt.Printf("%vDownloading %v...\n", LINE_PADDING, downloadURL)
+	client := http.Client{Timeout: 5 * time.Minute}
+	response, err := client.Get(downloadURL)
+	AssertNoErr(err, fmt.Sprintf("Could not download %v.", downloadURL))
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		PrintMessageAndQuit(fmt.Sprintf("Downloading %v failed with '%v'.", downloadURL, response.Status))
+	}
+
+	file, err := os.CreateTemp("", "snakeplant-download-*")
+	AssertNoErr(err, "Could not create a temp file to download to.")
+	defer file.Close()
+	_, err = io.Copy(file, response.Body)
+	AssertNoErr(err, fmt.Sprintf("Could not download %v.", downloadURL))
+	return file.Name()
+}
+
+// Streams the file over its own ssh session instead of reading it all into memory, since docker's packages alone are
+// a couple hundred MB.
+func uploadFile(client *simplessh.Client, localPath string, remotePath string) {
+	file, err := os.Open(localPath)
+	AssertNoErr(err, fmt.Sprintf("Could not open %v.", localPath))
+	defer file.Close()
+
+	session, err := client.SSHClient.NewSession()
+	AssertNoErr(err, "Could not open session for uploading a file.")
+	defer session.Close()
+
+	session.Stdin = file
+	tempFile := fmt.Sprintf("%v.snakeplant-tmp", remotePath)
+	output, err := session.CombinedOutput(fmt.Sprintf("mkdir -p \"%v\" && cat > \"%v\" && chmod 644 \"%v\" && mv \"%v\" \"%v\"", path.Dir(remotePath), tempFile, tempFile, tempFile, remotePath))
+	if err != nil {
+		color.Red("%v%v\n", LINE_PADDING, string(output))
+	}
+	AssertNoErr(err, fmt.Sprintf("Unable to upload %v.", localPath))
+}
+
+func remoteSha256(client *simplessh.Client, remotePath string) string {
+	out, err := client.Exec(fmt.Sprintf("sha256sum \"%v\" 2>/dev/null | awk '{print $1}'", remotePath))
+	AssertNoErr(err, fmt.Sprintf("Could not get the hash of %v.", remotePath))
+	return strings.TrimSpace(string(out))
+}
+
+// Uploads whatever isn't on the server yet, or is different there, and removes what isn't in the cache anymore.
+// Everything is checked again on the server once it's there.
+func (c artifactCache) upload(client *simplessh.Client, manifest map[string]string) {
+	for _, name := range sortedKeys(manifest) {
+		remotePath := path.Join(remoteArtifactsDir, name)
+		if remoteSha256(client, remotePath) == manifest[name] {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(c.dir, filepath.FromSlash(name)))
+		AssertNoErr(err, fmt.Sprintf("Could not stat %v.", name))
+		PrintSubStepInformation(fmt.Sprintf("%vUploading %v (%vKB).", LINE_PADDING, name, info.Size()>>10))
+		uploadFile(client, filepath.Join(c.dir, filepath.FromSlash(name)), remotePath)
+	}
+
+	WriteRemoteFile(client, path.Join(remoteArtifactsDir, artifactManifestName), []byte(c.manifestContent(manifest)), 0644)
+	out, err := client.Exec(fmt.Sprintf("cd %v && find pack debs -type f 2>/dev/null; true", remoteArtifactsDir))
+	AssertNoErr(err, fmt.Sprintf("Could not list %v.", remoteArtifactsDir))
+	for _, name := range strings.Fields(string(out)) {
+		if _, ok := manifest[name]; !ok && !strings.HasPrefix(name, "debs/Packages") {
+			SSHCommand(client, fmt.Sprintf("rm -f %v/%v", remoteArtifactsDir, name))
+		}
+	}
+
+	out, err = client.Exec(fmt.Sprintf("cd %v && sha256sum --quiet -c %v", remoteArtifactsDir, artifactManifestName))
+	if err != nil {
+		PrintMessageAndQuit(fmt.Sprintf("The cache didn't make it to the server intact:\n%v%v", LINE_PADDING, strings.TrimSpace(string(out))))
+	}
+}
+
+// Makes the uploaded packages into an apt repository that only this server can see, the same way dpkg-scanpackages
+// would if it were installed. It doesn't need signing, since every file was checked against the manifest.
+func writeArtifactRepository(client *simplessh.Client) {
+	SSHCommand(client, fmt.Sprintf(`mkdir -p %v/debs && cd %v/debs && for deb in *.deb; do [ -f "$deb" ] || continue; dpkg-deb -f "$deb"; echo "Filename: ./$deb"; echo "Size: $(stat -c %%s "$deb")"; echo "SHA256: $(sha256sum "$deb" | cut -d' ' -f1)"; echo; done > Packages.snakeplant-tmp && mv Packages.snakeplant-tmp Packages`, remoteArtifactsDir, remoteArtifactsDir))
+	WriteRemoteFile(client, artifactSourcesPath, []byte(fmt.Sprintf("deb [trusted=yes] file:%v/debs ./\n", remoteArtifactsDir)), 0644)
+}
+
+// When setup runs from a cache, apt only looks at the cache's repository, so nothing tries to reach a mirror.
+func aptSourceOptions() string {
+	if *Flags.Setup.ArtifactCache == "" {
+		return ""
+	}
+	return fmt.Sprintf("-o Dir::Etc::SourceList=%v -o Dir::Etc::SourceParts=- -o APT::Get::List-Cleanup=0", artifactSourcesPath)
+}
+
+func uploadArtifactsStep(client *simplessh.Client, cache artifactCache, manifest map[string]string) Step {
+	return Step{
+		Name:        "upload-artifacts",
+		Description: "Uploading the artifact cache",
+		Inputs:      []string{cache.manifestContent(manifest)},
+		Check: func() bool {
+			_, err := client.Exec(fmt.Sprintf("cd %v && sha256sum --quiet -c %v && [ -f %v ]", remoteArtifactsDir, artifactManifestName, artifactSourcesPath))
+			AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check the artifact cache on the server.")
+			if err != nil {
+				return true
+			}
+			uploaded, _ := readRemoteFile(client, path.Join(remoteArtifactsDir, artifactManifestName))
+			return uploaded != cache.manifestContent(manifest)
+		},
+		Apply: func() {
+			cache.upload(client, manifest)
+			writeArtifactRepository(client)
+		},
+	}
+}
+
+// Puts the cache's copy of the pack release somewhere installPack can use it, instead of it being downloaded.
+func uploadCachedPack(client *simplessh.Client, cache artifactCache, pack packArtifact, arch string) string {
+	name := packCachePath(pack)
+	manifest := cache.verify()
+	if _, ok := manifest[name]; !ok {
+		PrintMessageAndQuit(fmt.Sprintf("%v doesn't have pack %v for this server. Add it with 'snakeplant cache add-pack --version %v --arch %v'.", cache.dir, pack.version, pack.version, arch))
+	}
+	remotePath := path.Join(remoteArtifactsDir, name)
+	if remoteSha256(client, remotePath) != pack.tarSha {
+		uploadFile(client, filepath.Join(cache.dir, filepath.FromSlash(name)), remotePath)
+	}
+	return remotePath
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manages a local cache of everything setup downloads, for servers that can't reach the internet.",
+	Long: `A cache is a directory on your machine with pack releases and .deb files in it. 'snakeplant setup --artifact-cache'
+checks everything in it, uploads it over ssh, and installs from it, so the server never has to download anything.
+
+The .deb files have to be everything setup installs, along with their dependencies, for the server's OS version and
+architecture. 'apt-get download' on a machine running the same OS version gets them, and 'snakeplant setup --plan'
+on a connected server shows what gets installed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+		os.Exit(0)
+	},
+}
+
+var cacheAddPackCmd = &cobra.Command{
+	Use:   "add-pack",
+	Short: "Downloads a pack release into the cache, or copies in one you already have, and checks it.",
+	Args:  cobra.NoArgs,
+	Run:   cacheAddPack,
+}
+
+var cacheAddDebsCmd = &cobra.Command{
+	Use:   "add-debs [file or url]...",
+	Short: "Copies .deb files into the cache, downloading the ones that are urls.",
+	Long: `'add-debs' copies .deb files into the cache. Their names have to be the ones Debian gives them, like
+'curl_7.88.1-10+deb12u5_amd64.deb'. When '--sha256sums' is given, each file has to match its hash in there. Otherwise
+the hash is recorded as it is now, and later checks only catch files that changed after they were added.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  cacheAddDebs,
+}
+
+var cacheVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Checks every file in the cache, and lists them.",
+	Args:  cobra.NoArgs,
+	Run:   cacheVerify,
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheAddPackCmd)
+	cacheCmd.AddCommand(cacheAddDebsCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	Flags.Cache.Dir = cacheCmd.PersistentFlags().StringP("dir", "", "", "The cache directory. It's created if it doesn't exist.")
+	Flags.Cache.PackVersion = cacheAddPackCmd.Flags().StringP("version", "", defaultPackVersion, fmt.Sprintf("The version of pack to add. One of: %v.", strings.Join(packVersions(), ", ")))
+	Flags.Cache.PackArch = cacheAddPackCmd.Flags().StringP("arch", "", "amd64", fmt.Sprintf("The architecture of the server. One of: %v.", strings.Join(supportedArchitectures, ", ")))
+	Flags.Cache.From = cacheAddPackCmd.Flags().StringP("from", "", "", "A pack tarball you already downloaded. Defaults to downloading it from GitHub.")
+	Flags.Cache.Sha256Sums = cacheAddDebsCmd.Flags().StringP("sha256sums", "", "", "A file of 'sha256  filename' lines that the .deb files have to match.")
+	cacheCmd.MarkPersistentFlagRequired("dir")
+}
+
+func cacheAddPack(cmd *cobra.Command, args []string) {
+	cache := artifactCache{dir: *Flags.Cache.Dir}
+	pack := findPackArtifact(*Flags.Cache.PackVersion, *Flags.Cache.PackArch)
+
+	source := *Flags.Cache.From
+	if source == "" {
+		source = downloadLocally(pack.url())
+		defer os.Remove(source)
+	}
+	if sha := fileSha256(source); sha != pack.tarSha {
+		PrintMessageAndQuit(fmt.Sprintf("%v has the sha256 '%v' instead of '%v'. It's corrupt, or someone is doing something sneaky.", source, sha, pack.tarSha))
+	}
+
+	cache.add(packCachePath(pack), source, pack.tarSha)
+	PrintSubStepInformation(fmt.Sprintf("Added pack %v for %v to %v.", pack.version, *Flags.Cache.PackArch, cache.dir))
+}
+
+func cacheAddDebs(cmd *cobra.Command, args []string) {
+	cache := artifactCache{dir: *Flags.Cache.Dir}
+	var expected map[string]string
+	if *Flags.Cache.Sha256Sums != "" {
+		expected = readSha256Sums(*Flags.Cache.Sha256Sums)
+	}
+
+	// Everything is checked before anything is added, so a bad file doesn't leave the cache half updated.
+	type deb struct{ fileName, source, sha string }
+	var debs []deb
+	for _, arg := range args {
+		source := arg
+		fileName := filepath.Base(arg)
+		if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+			parsed, err := url.Parse(arg)
+			AssertNoErr(err, fmt.Sprintf("'%v' is not a url.", arg))
+			fileName = path.Base(parsed.Path)
+			source = downloadLocally(arg)
+			defer os.Remove(source)
+		}
+
+		if _, _, _, ok := parseDebFileName(fileName); !ok {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' isn't named like a Debian package, which is 'name_version_arch.deb'.", fileName))
+		}
+		sha := fileSha256(source)
+		if expected != nil {
+			if want, ok := expected[fileName]; !ok {
+				PrintMessageAndQuit(fmt.Sprintf("%v isn't in %v.", fileName, *Flags.Cache.Sha256Sums))
+			} else if want != sha {
+				PrintMessageAndQuit(fmt.Sprintf("%v has the sha256 '%v' instead of '%v'. It's corrupt, or someone is doing something sneaky.", fileName, sha, want))
+			}
+		}
+		debs = append(debs, deb{fileName, source, sha})
+	}
+
+	for _, d := range debs {
+		cache.add(path.Join("debs", d.fileName), d.source, d.sha)
+		name, version, arch, _ := parseDebFileName(d.fileName)
+		PrintSubStepInformation(fmt.Sprintf("Added %v %v for %v.", name, version, arch))
+	}
+	if expected == nil {
+		color.Yellow("There was no '--sha256sums' to check against, so the files were added as they are.")
+	}
+}
+
+func cacheVerify(cmd *cobra.Command, args []string) {
+	cache := artifactCache{dir: *Flags.Cache.Dir}
+	manifest := cache.verify()
+	for _, name := range sortedKeys(manifest) {
+		fmt.Printf("%v  %v\n", manifest[name][:12], name)
+	}
+	PrintSubStepInformation(fmt.Sprintf("All %v files in %v are intact.", len(manifest), cache.dir))
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"time"
+)
+
+var bansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "Shows and clears addresses that were stopped from using ssh.",
+	Long: `'bans' works with whatever 'setup --ssh-protection' set up: the addresses fail2ban banned for failing to log in,
+and the ones the firewall's ssh rate limit is keeping track of.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+		os.Exit(0)
+	},
+}
+
+var bansListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Shows the addresses that are banned right now.",
+	Args:  cobra.NoArgs,
+	Run:   bansList,
+}
+
+var bansUnbanCmd = &cobra.Command{
+	Use:   "unban <ip>",
+	Short: "Lets an address use ssh again right away.",
+	Long: `'unban' takes the address out of fail2ban's ssh jail, and makes the ssh rate limit forget about it. Handy for
+when you've locked yourself out by getting your password wrong too many times.`,
+	Args: cobra.ExactArgs(1),
+	Run:  bansUnban,
+}
+
+func init() {
+	RootCmd.AddCommand(bansCmd)
+	bansCmd.AddCommand(bansListCmd)
+	bansCmd.AddCommand(bansUnbanCmd)
+	Flags.Bans.Port = bansCmd.PersistentFlags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	Flags.Bans.Host = bansCmd.PersistentFlags().StringP("host", "", "", "The host name or IP address of your server.")
+	Flags.Bans.Key = bansCmd.PersistentFlags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	bansCmd.MarkPersistentFlagRequired("host")
+}
+
+func dialBans() *simplessh.Client {
+	client, err := simplessh.ConnectWithKeyFileTimeout(fmt.Sprintf("%v:%v", *Flags.Bans.Host, *Flags.Bans.Port), "root", *Flags.Bans.Key, 5*time.Second)
+	AssertNoErr(err, "Unable to establish a connection.")
+	return client
+}
+
+// The backend is only returned if the saved firewall policy has the ssh rate limit turned on.
+func rateLimitBackend(client *simplessh.Client) (firewallBackend, bool) {
+	saved, ok := readSavedFirewall(client)
+	if !ok || saved.Policy.SSHRateLimit == 0 {
+		return nil, false
+	}
+	return chooseFirewallBackend(saved.Backend, platform{}), true
+}
+
+func printAddresses(addresses []string) {
+	if len(addresses) == 0 {
+		PrintSubStepInformation(fmt.Sprintf("%vNone.", LINE_PADDING))
+	}
+	for _, address := range addresses {
+		PrintSubStepInformation(fmt.Sprintf("%v%v", LINE_PADDING, address))
+	}
+}
+
+func bansList(command *cobra.Command, args []string) {
+	client := dialBans()
+	defer client.Close()
+
+	banned, jailRunning := fail2banBannedAddresses(client)
+	backend, rateLimited := rateLimitBackend(client)
+	if !jailRunning && !rateLimited {
+		PrintMessageAndQuit("Neither fail2ban nor the ssh rate limit is set up on this server. 'snakeplant setup --ssh-protection' sets one up.")
+	}
+
+	if jailRunning {
+		PrintSubStepInformation(fmt.Sprintf("Banned by fail2ban's '%v' jail:", fail2banJail))
+		printAddresses(banned)
+	}
+	if rateLimited {
+		if jailRunning {
+			fmt.Println()
+		}
+		// The rate limit doesn't say which addresses are over it, only which ones it's counting.
+		PrintSubStepInformation("Connected recently, and counted by the ssh rate limit:")
+		printAddresses(backend.rateLimitedSources(client))
+	}
+}
+
+func bansUnban(command *cobra.Command, args []string) {
+	ip := net.ParseIP(args[0])
+	if ip == nil {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not an IP address.", args[0]))
+	}
+
+	client := dialBans()
+	defer client.Close()
+
+	cleared := false
+	if banned, jailRunning := fail2banBannedAddresses(client); jailRunning {
+		for _, address := range banned {
+			if bannedIP := net.ParseIP(address); bannedIP != nil && bannedIP.Equal(ip) {
+				SSHCommand(client, fmt.Sprintf("fail2ban-client set %v unbanip %v", fail2banJail, ip))
+				PrintSubStepInformation(fmt.Sprintf("%v isn't banned by fail2ban anymore.", ip))
+				cleared = true
+			}
+		}
+	}
+	if backend, rateLimited := rateLimitBackend(client); rateLimited && backend.clearRateLimit(client, ip) {
+		PrintSubStepInformation(fmt.Sprintf("The ssh rate limit forgot about %v.", ip))
+		cleared = true
+	}
+
+	if !cleared {
+		PrintSubStepInformation(fmt.Sprintf("%v wasn't banned, so nothing was changed.", ip))
+	}
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"strings"
+)
+
+// How many unchanged lines are shown around each change, same as 'diff -u'.
+const diffContextLines = 3
+
+type diffLine struct {
+	// ' ' for a line both sides have, '-' for one only the old side has, '+' for one only the new side has.
+	kind byte
+	text string
+}
+
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// A plain longest common subsequence diff. It's quadratic, but the files snakeplant manages are config files with at
+// most a few hundred lines.
+func diffLines(from, to []string) []diffLine {
+	// lengths[i][j] is the length of the longest common subsequence of from[i:] and to[j:].
+	lengths := make([][]int, len(from)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			lines = append(lines, diffLine{' ', from[i]})
+			i++
+			j++
+		case j == len(to) || (i < len(from) && lengths[i+1][j] >= lengths[i][j+1]):
+			lines = append(lines, diffLine{'-', from[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', to[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// Returns the difference between from and to in the same format as 'diff -u', or "" if there isn't any.
+func unifiedDiff(fromName, toName, from, to string) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	// Where each line is in the old and new file, for the hunk headers.
+	fromLine := make([]int, len(lines)+1)
+	toLine := make([]int, len(lines)+1)
+	for i, line := range lines {
+		fromLine[i+1], toLine[i+1] = fromLine[i], toLine[i]
+		if line.kind != '+' {
+			fromLine[i+1]++
+		}
+		if line.kind != '-' {
+			toLine[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	i := 0
+	for i < len(lines) {
+		for i < len(lines) && lines[i].kind == ' ' {
+			i++
+		}
+		if i == len(lines) {
+			break
+		}
+
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+
+		// Changes close enough together that their context would overlap go in the same hunk.
+		end := i
+		for {
+			for end < len(lines) && lines[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(lines) && lines[next].kind == ' ' {
+				next++
+			}
+			if next < len(lines) && next-end <= 2*diffContextLines {
+				end = next
+				continue
+			}
+			end += diffContextLines
+			if end > len(lines) {
+				end = len(lines)
+			}
+			break
+		}
+
+		fromStart, fromCount := fromLine[start]+1, fromLine[end]-fromLine[start]
+		toStart, toCount := toLine[start]+1, toLine[end]-toLine[start]
+		// An empty range is named by the line before it.
+		if fromCount == 0 {
+			fromStart--
+		}
+		if toCount == 0 {
+			toStart--
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %v\n+++ %v\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", hunkRange(fromStart, fromCount), hunkRange(toStart, toCount))
+		for _, line := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%v\n", line.kind, line.text)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// Like 'diff -u', the count is left off when it's 1.
+func hunkRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%v,%v", start, count)
+}
+
+func printUnifiedDiff(diff string) {
+	for _, line := range splitLines(diff) {
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") || strings.HasPrefix(line, "@@"):
+			color.Cyan("%v%v", LINE_PADDING, line)
+		case strings.HasPrefix(line, "+"):
+			color.Green("%v%v", LINE_PADDING, line)
+		case strings.HasPrefix(line, "-"):
+			color.Red("%v%v", LINE_PADDING, line)
+		default:
+			fmt.Printf("%v%v\n", LINE_PADDING, line)
+		}
+	}
+}
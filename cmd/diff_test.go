@@ -0,0 +1,76 @@
+package cmd
+
+import "testing"
+
+// The expected hunks are what GNU 'diff -u' prints for the same input.
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  string
+		to    string
+		hunks string
+	}{
+		{
+			name: "identical",
+			from: "a\nb\n",
+			to:   "a\nb\n",
+		},
+		{
+			name: "both empty",
+		},
+		{
+			name:  "insert at the start",
+			from:  "b\nc\n",
+			to:    "a\nb\nc\n",
+			hunks: "@@ -1,2 +1,3 @@\n+a\n b\n c\n",
+		},
+		{
+			name:  "delete at the end",
+			from:  "a\nb\nc\n",
+			to:    "a\nb\n",
+			hunks: "@@ -1,3 +1,2 @@\n a\n b\n-c\n",
+		},
+		{
+			name:  "empty to non-empty",
+			from:  "",
+			to:    "a\nb\n",
+			hunks: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:  "non-empty to empty",
+			from:  "a\n",
+			to:    "",
+			hunks: "@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name:  "change in the middle",
+			from:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			to:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			hunks: "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:  "changes 2x context apart are merged",
+			from:  "x\n1\n2\n3\n4\n5\n6\ny\n",
+			to:    "X\n1\n2\n3\n4\n5\n6\nY\n",
+			hunks: "@@ -1,8 +1,8 @@\n-x\n+X\n 1\n 2\n 3\n 4\n 5\n 6\n-y\n+Y\n",
+		},
+		{
+			name:  "changes more than 2x context apart are split",
+			from:  "x\n1\n2\n3\n4\n5\n6\n7\ny\n",
+			to:    "X\n1\n2\n3\n4\n5\n6\n7\nY\n",
+			hunks: "@@ -1,4 +1,4 @@\n-x\n+X\n 1\n 2\n 3\n@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-y\n+Y\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := ""
+			if test.hunks != "" {
+				want = "--- old\n+++ new\n" + test.hunks
+			}
+			if got := unifiedDiff("old", "new", test.from, test.to); got != want {
+				t.Errorf("unifiedDiff(%q, %q) =\n%v\nwant:\n%v", test.from, test.to, got, want)
+			}
+		})
+	}
+}
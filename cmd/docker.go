@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+)
+
+const (
+	dockerDaemonConfPath = "/etc/docker/daemon.json"
+	dockerKeyringPath    = "/etc/apt/keyrings/docker.asc"
+	dockerSourcesPath    = "/etc/apt/sources.list.d/docker.list"
+	// From https://docs.docker.com/engine/install/ubuntu/. The key is only trusted if it has this fingerprint.
+	dockerKeyFingerprint = "9DC858229FC7DD38854AE2D88D81803C0EBFCD88"
+)
+
+// The two ways to get the docker engine. Never 'docker', which on Ubuntu is an old window manager dock.
+type dockerEngine struct {
+	name string
+	// The package that the version is pinned on. The rest are installed and held alongside it.
+	mainPackage string
+	packages    []string
+	// Whether it comes from Docker's own apt repository instead of the OS's.
+	official bool
+}
+
+var dockerEngines = []dockerEngine{
+	// Docker's own build. Newer than the OS's, and it's what Docker's documentation assumes.
+	{name: "docker-ce", mainPackage: "docker-ce", packages: []string{"docker-ce", "docker-ce-cli", "containerd.io"}, official: true},
+	// Built by the OS, so it gets the OS's security updates, but it can be a few versions behind.
+	{name: "docker.io", mainPackage: "docker.io", packages: []string{"docker.io", "containerd"}},
+}
+
+func findDockerEngine(name string) dockerEngine {
+	var names []string
+	for _, engine := range dockerEngines {
+		if engine.name == name {
+			return engine
+		}
+		names = append(names, engine.name)
+	}
+	PrintMessageAndQuit(fmt.Sprintf("'%v' is not a docker engine snakeplant knows about. It has to be one of: %v.", name, strings.Join(names, ", ")))
+	return dockerEngine{}
+}
+
+func allDockerPackages() []string {
+	var packages []string
+	for _, engine := range dockerEngines {
+		packages = append(packages, engine.packages...)
+	}
+	return packages
+}
+
+type dockerOptions struct {
+	engine dockerEngine
+	// The upstream version, like '27.3.1'. Empty means whatever is newest the first time it's installed, and then that
+	// version is kept.
+	version     string
+	logMaxSize  string
+	logMaxFiles int
+	// The packages come from the artifact cache instead of Docker's repository.
+	fromCache bool
+}
+
+func (p platform) dockerSourcesLine() string {
+	return fmt.Sprintf("deb [arch=%v signed-by=%v] https://download.docker.com/linux/%v %v stable\n", p.arch, dockerKeyringPath, p.id, p.codename)
+}
+
+// apt versions look like '5:27.3.1-1~ubuntu.24.04~noble' or '24.0.7-0ubuntu2~22.04.1'. This is the '27.3.1' part.
+func upstreamVersion(aptVersion string) string {
+	if _, rest, ok := strings.Cut(aptVersion, ":"); ok {
+		aptVersion = rest
+	}
+	upstream, _, _ := strings.Cut(aptVersion, "-")
+	return upstream
+}
+
+func heldPackages(client *simplessh.Client) []string {
+	out, err := client.Exec("apt-mark showhold")
+	AssertNoErr(err, "Could not list held packages.")
+	return strings.Fields(string(out))
+}
+
+// Finds the apt version of the package that matches the upstream version, from the repositories the server has.
+func resolveAptVersion(client *simplessh.Client, packageName string, version string) string {
+	out, err := client.Exec(fmt.Sprintf("apt-cache %v madison %v", aptSourceOptions(), packageName))
+	AssertNoErr(err, fmt.Sprintf("Could not list the versions of %v.", packageName))
+
+	var available []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		aptVersion := strings.TrimSpace(fields[1])
+		if upstreamVersion(aptVersion) == version {
+			return aptVersion
+		}
+		available = append(available, upstreamVersion(aptVersion))
+	}
+	PrintMessageAndQuit(fmt.Sprintf("%v %v isn't in any of the server's apt repositories. These versions are: %v.", packageName, version, strings.Join(available, ", ")))
+	return ""
+}
+
+func (o dockerOptions) daemonConf(current string) string {
+	// Settings someone added by hand are kept. Only the ones snakeplant cares about are set.
+	conf := map[string]interface{}{}
+	if strings.TrimSpace(current) != "" {
+		err := json.Unmarshal([]byte(current), &conf)
+		AssertNoErr(err, fmt.Sprintf("%v isn't valid JSON, so snakeplant can't add to it. Fix or remove it.", dockerDaemonConfPath))
+	}
+
+	conf["log-driver"] = "json-file"
+	conf["log-opts"] = map[string]string{
+		"max-size": o.logMaxSize,
+		"max-file": fmt.Sprint(o.logMaxFiles),
+	}
+	// Containers keep running while dockerd restarts, like when it's upgraded or this file changes.
+	conf["live-restore"] = true
+
+	content, err := json.MarshalIndent(conf, "", "  ")
+	AssertNoErr(err, "Could not serialize the docker daemon config.")
+	return string(content) + "\n"
+}
+
+func validateDockerDaemonConf(client *simplessh.Client, stagedPath string) {
+	out, err := client.Exec(fmt.Sprintf("dockerd --validate --config-file %v", stagedPath))
+	if err != nil {
+		// Versions before 23.0 don't have '--validate'. 'docker info' still checks the config after the restart.
+		if strings.Contains(string(out), "unknown flag") {
+			return
+		}
+		PrintMessageAndQuit(fmt.Sprintf("dockerd says the new %v is wrong:\n%v%v", dockerDaemonConfPath, LINE_PADDING, strings.TrimSpace(string(out))))
+	}
+}
+
+func dockerSteps(client *simplessh.Client, target platform, options dockerOptions) []Step {
+	engine := options.engine
+	var steps []Step
+
+	installDependencies := []string{"install-packages"}
+	if engine.official && !options.fromCache {
+		sources := managedFile{
+			path:  dockerSourcesPath,
+			owner: "root:root",
+			mode:  0644,
+			render: func(string) string {
+				return target.dockerSourcesLine()
+			},
+		}
+
+		steps = append(steps,
+			Step{
+				Name:        "add-docker-repository",
+				Description: "Adding Docker's apt repository",
+				DependsOn:   []string{"install-packages"},
+				Inputs:      []string{dockerKeyFingerprint, target.dockerSourcesLine()},
+				Check: func() bool {
+					return dockerKeyFingerprintOf(client, dockerKeyringPath) != dockerKeyFingerprint || sources.needsChange(client)
+				},
+				Apply: func() {
+					SSHCommand(client, "install -m 0755 -d /etc/apt/keyrings")
+					curlCommand(client, fmt.Sprintf("-m 20 -f -L -s -o %v.download https://download.docker.com/linux/%v/gpg", dockerKeyringPath, target.id))
+					if fingerprint := dockerKeyFingerprintOf(client, dockerKeyringPath+".download"); fingerprint != dockerKeyFingerprint {
+						PrintMessageAndQuit(fmt.Sprintf("Docker's signing key has the fingerprint '%v' instead of '%v'. Either it changed, or someone is doing something sneaky.", fingerprint, dockerKeyFingerprint))
+					}
+					SSHCommand(client, fmt.Sprintf("chmod 644 %v.download && mv %v.download %v", dockerKeyringPath, dockerKeyringPath, dockerKeyringPath))
+
+					if sources.needsChange(client) {
+						sources.apply(client)
+					}
+					aptGet(client, "update")
+				},
+			},
+		)
+		installDependencies = append(installDependencies, "add-docker-repository")
+	}
+
+	isInstalled := func() bool {
+		version, ok := installedPackageVersion(client, engine.mainPackage)
+		if !ok || (options.version != "" && upstreamVersion(version) != options.version) {
+			return false
+		}
+		held := heldPackages(client)
+		for _, packageName := range engine.packages {
+			if !containsString(held, packageName) {
+				return false
+			}
+		}
+		return true
+	}
+
+	steps = append(steps,
+		Step{
+			Name:        "install-docker",
+			Description: fmt.Sprintf("Installing %v", engine.name),
+			DependsOn:   installDependencies,
+			Inputs:      []string{engine.name, options.version},
+			Check: func() bool {
+				return !isInstalled()
+			},
+			Apply: func() {
+				current, installed := installedPackageVersion(client, engine.mainPackage)
+				desired := options.version
+				if desired == "" {
+					desired = "the newest version"
+					if installed {
+						desired = upstreamVersion(current)
+					}
+				}
+				if installed {
+					PrintSubStepInformation(fmt.Sprintf("%v%v %v is installed. It should be %v, and held.", LINE_PADDING, engine.mainPackage, upstreamVersion(current), desired))
+				} else {
+					PrintSubStepInformation(fmt.Sprintf("%v%v isn't installed. It should be %v, and held.", LINE_PADDING, engine.mainPackage, desired))
+				}
+
+				// Held packages can't be upgraded, downgraded or swapped for the other engine, so everything is let go
+				// first and held again at the end.
+				var held []string
+				for _, packageName := range heldPackages(client) {
+					if containsString(allDockerPackages(), packageName) {
+						held = append(held, packageName)
+					}
+				}
+				if len(held) > 0 {
+					SSHCommand(client, fmt.Sprintf("apt-mark unhold %v", strings.Join(held, " ")))
+				}
+
+				packages := make([]aptPackage, len(engine.packages))
+				for i, packageName := range engine.packages {
+					packages[i] = aptPackage{name: packageName}
+				}
+				if options.version != "" {
+					aptVersion := resolveAptVersion(client, engine.mainPackage, options.version)
+					packages[0].version = aptVersion
+					// The cli is built alongside the engine, and has to be the same version.
+					if engine.official {
+						packages[1].version = aptVersion
+					}
+				}
+				installPackages(client, packages, "--allow-downgrades")
+				SSHCommand(client, fmt.Sprintf("apt-mark hold %v", strings.Join(engine.packages, " ")))
+			},
+		},
+		Step{
+			Name:        "configure-docker",
+			Description: "Configuring the docker daemon",
+			DependsOn:   []string{"install-docker"},
+			Inputs:      []string{options.logMaxSize, fmt.Sprint(options.logMaxFiles)},
+			Check: func() bool {
+				return dockerDaemonFile(options).needsChange(client)
+			},
+			Apply: func() {
+				dockerDaemonFile(options).apply(client)
+				// With live-restore on, running containers aren't stopped by this.
+				SSHCommand(client, "systemctl restart docker")
+			},
+		},
+		Step{
+			Name:        "verify-docker",
+			Description: "Checking docker is running",
+			DependsOn:   []string{"configure-docker"},
+			AlwaysRun:   true,
+			Apply: func() {
+				out, err := client.Exec("docker info --format '{{.ServerVersion}} {{.LoggingDriver}} {{.LiveRestoreEnabled}}'")
+				if err != nil {
+					PrintMessageAndQuit(fmt.Sprintf("'docker info' failed, so the docker daemon isn't running right:\n%v%v\n%v'journalctl -u docker' has more.", LINE_PADDING, strings.TrimSpace(string(out)), LINE_PADDING))
+				}
+
+				fields := strings.Fields(string(out))
+				if len(fields) != 3 || fields[1] != "json-file" || fields[2] != "true" {
+					color.Yellow("%vdocker is running, but isn't using the settings in %v: '%v'. It may need to be restarted with 'systemctl restart docker'.", LINE_PADDING, dockerDaemonConfPath, strings.TrimSpace(string(out)))
+					return
+				}
+				PrintSubStepInformation(fmt.Sprintf("%vdocker %v is running, with log rotation and live-restore on.", LINE_PADDING, fields[0]))
+			},
+		},
+	)
+	return steps
+}
+
+func dockerDaemonFile(options dockerOptions) managedFile {
+	return managedFile{
+		path:     dockerDaemonConfPath,
+		owner:    "root:root",
+		mode:     0644,
+		render:   options.daemonConf,
+		validate: validateDockerDaemonConf,
+	}
+}
+
+func dockerKeyFingerprintOf(client *simplessh.Client, keyPath string) string {
+	out, err := client.Exec(fmt.Sprintf("gpg --show-keys --with-colons %v 2>/dev/null | awk -F: '$1 == \"fpr\" { print $10; exit }'", keyPath))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
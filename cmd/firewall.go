@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Shows and changes your server's firewall.",
+	Long: `'firewall' works on the same rules that 'setup' created, so anything changed here stays consistent with what
+'setup' would generate, and is kept when 'setup' runs again. Every change is loaded with the same automatic rollback
+that 'setup' uses, and then persisted so it survives a reboot.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+		os.Exit(0)
+	},
+}
+
+var firewallListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Shows the firewall rules that are loaded right now, and explains what each one does.",
+	Long: `'list' asks the server for the rules that are actually loaded, not the ones snakeplant thinks should be, and
+explains each line. Rules that snakeplant didn't add are shown too, so nothing is hidden from you.`,
+	Args: cobra.NoArgs,
+	Run:  firewallList,
+}
+
+var firewallAllowCmd = &cobra.Command{
+	Use:   "allow <port>[/tcp|/udp]",
+	Short: "Opens a port.",
+	Long: `'allow' opens a port, like 'snakeplant firewall allow 8080/tcp'. The protocol defaults to tcp.
+With '--from', the port is only opened to those sources, like 'snakeplant firewall allow 5432/tcp --from 10.0.0.0/8'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(command *cobra.Command, args []string) {
+		changeFirewall(args[0], *Flags.Firewall.AllowFrom, (*firewallPolicy).allow)
+	},
+}
+
+var firewallDenyCmd = &cobra.Command{
+	Use:   "deny <port>[/tcp|/udp]",
+	Short: "Closes a port.",
+	Long: `'deny' closes a port that was opened by 'allow' or by 'setup --tcp-ports'. With '--from', only those sources lose
+access and the port stays open to the rest. ssh and the web ports can't be closed this way.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(command *cobra.Command, args []string) {
+		changeFirewall(args[0], *Flags.Firewall.DenyFrom, (*firewallPolicy).deny)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(firewallCmd)
+	firewallCmd.AddCommand(firewallListCmd)
+	firewallCmd.AddCommand(firewallAllowCmd)
+	firewallCmd.AddCommand(firewallDenyCmd)
+	Flags.Firewall.Port = firewallCmd.PersistentFlags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	Flags.Firewall.Host = firewallCmd.PersistentFlags().StringP("host", "", "", "The host name or IP address of your server.")
+	Flags.Firewall.Key = firewallCmd.PersistentFlags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	Flags.Firewall.RollbackSeconds = firewallCmd.PersistentFlags().IntP("firewall-rollback-seconds", "", 60, "If a new ssh connection can't be made this many seconds after loading the new rules, they are rolled back so you aren't locked out.")
+	Flags.Firewall.AllowFrom = firewallAllowCmd.Flags().StringSliceP("from", "", []string{}, "Only open the port to this IP address or CIDR. Can be given more than once.")
+	Flags.Firewall.DenyFrom = firewallDenyCmd.Flags().StringSliceP("from", "", []string{}, "Only take away access from this IP address or CIDR. Can be given more than once.")
+	firewallCmd.MarkPersistentFlagRequired("host")
+}
+
+func dialFirewall() (*simplessh.Client, error) {
+	return simplessh.ConnectWithKeyFileTimeout(fmt.Sprintf("%v:%v", *Flags.Firewall.Host, *Flags.Firewall.Port), "root", *Flags.Firewall.Key, 5*time.Second)
+}
+
+func readSavedFirewallOrQuit(client *simplessh.Client) savedFirewall {
+	saved, ok := readSavedFirewall(client)
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("There's no firewall policy at %v. Run 'snakeplant setup' first.", firewallPolicyPath))
+	}
+	return saved
+}
+
+func firewallList(command *cobra.Command, args []string) {
+	client, err := dialFirewall()
+	AssertNoErr(err, "Unable to establish a connection.")
+	defer client.Close()
+
+	saved := readSavedFirewallOrQuit(client)
+	backend := chooseFirewallBackend(saved.Backend, platform{})
+
+	PrintSubStepInformation(fmt.Sprintf("The firewall is managed with %v.\n", backend))
+	backend.explainLiveRules(client)
+}
+
+// Takes things like '8080', '8080/tcp' or '51820/udp'.
+func parsePortAndProtocol(spec string) (int, string) {
+	portStr, protocol, hasProtocol := strings.Cut(spec, "/")
+	if !hasProtocol {
+		protocol = "tcp"
+	}
+
+	protocol = strings.ToLower(protocol)
+	if protocol != "tcp" && protocol != "udp" {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not a protocol. It has to be 'tcp' or 'udp'.", protocol))
+	}
+	return parsePort(portStr), protocol
+}
+
+func changeFirewall(spec string, from []string, change func(*firewallPolicy, int, string, []string) string) {
+	port, protocol := parsePortAndProtocol(spec)
+
+	var sources []string
+	for _, source := range from {
+		sources = append(sources, parseSource(source))
+	}
+
+	client, err := dialFirewall()
+	AssertNoErr(err, "Unable to establish a connection.")
+	defer client.Close()
+
+	saved := readSavedFirewallOrQuit(client)
+	policy := saved.Policy
+	backend := chooseFirewallBackend(saved.Backend, platform{})
+
+	description := change(&policy, port, protocol, sources)
+	if description == "" {
+		PrintSubStepInformation("The firewall already does that, so nothing was changed.")
+		return
+	}
+
+	counter := 1
+	step(&counter, "Loading firewall rules", func() {
+		applyFirewallPolicy(client, backend, policy, dialFirewall, time.Duration(*Flags.Firewall.RollbackSeconds)*time.Second)
+	})
+
+	step(&counter, "Persisting firewall rules", func() {
+		backend.persist(client, policy)
+		writeSavedFirewall(client, backend, policy)
+	})
+
+	PrintSubStepInformation(description)
+}
@@ -0,0 +1,451 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are always open, since serving web traffic is the whole point of the server.
+var webPorts = []int{80, 443, 444}
+
+// Where a rule came from. Setup decides its own rules from scratch every time it runs, but it has to keep the ones
+// 'snakeplant firewall allow' added.
+const (
+	ruleFromSetup = "setup"
+	ruleFromAllow = "allow"
+)
+
+// One port that's allowed through the firewall. No sources means it's open to everyone.
+type portRule struct {
+	Port     int      `json:"port"`
+	Protocol string   `json:"protocol"`
+	Sources  []string `json:"sources,omitempty"`
+	// ruleFromSetup or ruleFromAllow. Policies saved before this was recorded don't have it.
+	From string `json:"from,omitempty"`
+}
+
+// Everything the firewall lets in, independent of how the rules actually get loaded. It's saved on the server so that
+// 'snakeplant firewall' can change it later.
+type firewallPolicy struct {
+	SSHPort    int      `json:"sshPort"`
+	SSHSources []string `json:"sshSources,omitempty"`
+	// How many new ssh connections one address can make in a minute before the rest are dropped. 0 means no limit.
+	SSHRateLimit int        `json:"sshRateLimit,omitempty"`
+	Rules        []portRule `json:"rules,omitempty"`
+}
+
+func newFirewallPolicy(sshPort int, sshSources []string, tcpPorts, udpPorts string) firewallPolicy {
+	policy := firewallPolicy{SSHPort: sshPort}
+
+	for _, source := range sshSources {
+		policy.SSHSources = append(policy.SSHSources, parseSource(source))
+	}
+
+	policy.Rules = append(policy.Rules, parsePortRules(tcpPorts, "tcp")...)
+	policy.Rules = append(policy.Rules, parsePortRules(udpPorts, "udp")...)
+	return policy
+}
+
+// Takes a comma separated list like '8080,5432@10.0.0.0/8,5432@192.168.1.7'. Anything after an '@' restricts the port
+// to that source. The same port can be listed more than once to allow more than one source.
+func parsePortRules(spec, protocol string) []portRule {
+	var rules []portRule
+	byPort := map[int]int{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		portStr, source, restricted := strings.Cut(entry, "@")
+		port := parsePort(portStr)
+
+		i, seen := byPort[port]
+		if !seen {
+			rules = append(rules, portRule{Port: port, Protocol: protocol, From: ruleFromSetup})
+			i = len(rules) - 1
+			byPort[port] = i
+		} else if !restricted || len(rules[i].Sources) == 0 {
+			PrintMessageAndQuit(fmt.Sprintf("%v/%v is listed more than once. That's only allowed when every entry restricts it to a source.", port, protocol))
+		}
+
+		if restricted {
+			rules[i].Sources = append(rules[i].Sources, parseSource(source))
+		}
+	}
+	return rules
+}
+
+func parsePort(portStr string) int {
+	port, err := strconv.Atoi(strings.TrimSpace(portStr))
+	if err != nil {
+		PrintMessageAndQuit(fmt.Sprintf("Could not convert port to integer: '%v'.", portStr))
+	}
+
+	if port < 1 || port > 65535 {
+		PrintMessageAndQuit(fmt.Sprintf("Port must be between 1 and 65535, inclusive: %v.", port))
+	}
+	return port
+}
+
+// Accepts either a CIDR like '10.0.0.0/8' or '2001:db8::/32', or a single address, which is turned into a '/32' or '/128'.
+func parseSource(source string) string {
+	source = strings.TrimSpace(source)
+
+	if _, network, err := net.ParseCIDR(source); err == nil {
+		return network.String()
+	}
+
+	if ip := net.ParseIP(source); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32"
+		}
+		return ip.String() + "/128"
+	}
+
+	PrintMessageAndQuit(fmt.Sprintf("'%v' is not a valid IP address or CIDR.", source))
+	return ""
+}
+
+func joinPorts(ports []int) string {
+	strs := make([]string, len(ports))
+	for i, port := range ports {
+		strs[i] = strconv.Itoa(port)
+	}
+	return strings.Join(strs, ",")
+}
+
+// How the policy actually gets turned into rules on the server.
+type firewallBackend interface {
+	String() string
+	// The packages the backend needs. They're installed along with everything else setup installs.
+	packages(target platform) []aptPackage
+	// Steps that run once the packages are installed.
+	installSteps(client *simplessh.Client, target platform) []Step
+	// Saves the rules that are loaded right now somewhere in dir, and returns a shell command that puts them back.
+	// The command can't contain single quotes.
+	snapshot(client *simplessh.Client, dir string) string
+	load(client *simplessh.Client, policy firewallPolicy)
+	// Makes the loaded rules survive a reboot.
+	persist(client *simplessh.Client, policy firewallPolicy)
+	missingRules(client *simplessh.Client, policy firewallPolicy) []string
+	// The addresses the ssh rate limit is keeping track of, which are the ones that connected recently.
+	rateLimitedSources(client *simplessh.Client) []string
+	// Makes the rate limit forget about the address, so it can connect again right away. Returns false if it wasn't
+	// being kept track of.
+	clearRateLimit(client *simplessh.Client, ip net.IP) bool
+	// Prints every rule that's loaded right now, along with what it does.
+	explainLiveRules(client *simplessh.Client)
+}
+
+var firewallBackends = []firewallBackend{iptablesBackend{}, nftablesBackend{}}
+
+// 'auto' means whatever the OS uses by default.
+func chooseFirewallBackend(name string, target platform) firewallBackend {
+	if name == "auto" {
+		name = target.firewallBackend
+	}
+
+	var names []string
+	for _, backend := range firewallBackends {
+		if backend.String() == name {
+			return backend
+		}
+		names = append(names, backend.String())
+	}
+
+	PrintMessageAndQuit(fmt.Sprintf("'%v' is not a firewall backend. Pick one of: auto, %v.", name, strings.Join(names, ", ")))
+	return nil
+}
+
+const firewallStateDir = "/var/local/snakeplant/firewall"
+const rollbackUnit = "snakeplant-firewall-rollback"
+
+// Loads the policy with a dead man's switch. Before anything changes, the server schedules putting the current rules
+// back. Then a brand new ssh connection is opened, and only if that works is the rollback cancelled.
+//
+// The connection we already have isn't good enough to prove anything, since it's let through by the RELATED,ESTABLISHED
+// rule no matter what the rest of the rules say. That's also why it keeps working long enough to cancel the rollback.
+func applyFirewallPolicy(client *simplessh.Client, backend firewallBackend, policy firewallPolicy, reconnect func() (*simplessh.Client, error), rollbackAfter time.Duration) {
+	_, err := client.Exec(fmt.Sprintf("mkdir -p %v", firewallStateDir))
+	AssertNoErr(err, fmt.Sprintf("Unable to create %v.", firewallStateDir))
+
+	restoreCommand := backend.snapshot(client, firewallStateDir)
+
+	// A rollback left over from a run that died half way through would undo what we're about to do.
+	cancelFirewallRollback(client)
+
+	SSHCommand(client, fmt.Sprintf("systemd-run --quiet --unit=%v --on-active=%v /bin/sh -c '%v'", rollbackUnit, int(rollbackAfter.Seconds()), restoreCommand))
+	PrintSubStepInformation(fmt.Sprintf("%vThe current rules will be put back in %v unless a new connection can be made.", LINE_PADDING, rollbackAfter))
+
+	backend.load(client, policy)
+
+	var reconnectErr error
+	for attempt := 1; attempt <= 3; attempt++ {
+		var newClient *simplessh.Client
+		newClient, reconnectErr = reconnect()
+		if reconnectErr == nil {
+			_, reconnectErr = newClient.Exec("true")
+			newClient.Close()
+		}
+		if reconnectErr == nil {
+			break
+		}
+		PrintSubStepInformation(fmt.Sprintf("%vAttempt %v at a new connection failed: %v", LINE_PADDING, attempt, reconnectErr))
+		time.Sleep(2 * time.Second)
+	}
+
+	if reconnectErr != nil {
+		PrintMessageAndQuit(fmt.Sprintf("Could not open a new ssh connection with the new firewall rules loaded, so they would have locked you out. The old rules will be put back within %v. Check '--port' and '--ssh-from'.", rollbackAfter))
+	}
+
+	_, err = client.Exec(fmt.Sprintf("systemctl is-active --quiet %v.timer", rollbackUnit))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking on the firewall rollback.")
+	if err != nil {
+		PrintMessageAndQuit("The new firewall rules worked, but the rollback already ran before it could be cancelled. Try again with a longer '--firewall-rollback-seconds'.")
+	}
+
+	cancelFirewallRollback(client)
+	PrintSubStepInformation(fmt.Sprintf("%vA new connection worked, so the rollback was cancelled.", LINE_PADDING))
+}
+
+func cancelFirewallRollback(client *simplessh.Client) {
+	SSHCommand(client, fmt.Sprintf("systemctl stop %v.timer %v.service 2>/dev/null; systemctl reset-failed %v.timer %v.service 2>/dev/null; true", rollbackUnit, rollbackUnit, rollbackUnit, rollbackUnit))
+}
+
+const firewallPolicyPath = firewallStateDir + "/policy.json"
+
+// What's saved on the server, so later changes are made with the same backend and on top of the same policy.
+type savedFirewall struct {
+	Backend string         `json:"backend"`
+	Policy  firewallPolicy `json:"policy"`
+}
+
+func readSavedFirewall(client *simplessh.Client) (savedFirewall, bool) {
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", firewallPolicyPath))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for a saved firewall policy.")
+	if err != nil {
+		return savedFirewall{}, false
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", firewallPolicyPath))
+	AssertNoErr(err, fmt.Sprintf("Could not read %v.", firewallPolicyPath))
+
+	var saved savedFirewall
+	err = json.Unmarshal(out, &saved)
+	AssertNoErr(err, fmt.Sprintf("%v is corrupt.", firewallPolicyPath))
+	return saved, true
+}
+
+func writeSavedFirewall(client *simplessh.Client, backend firewallBackend, policy firewallPolicy) {
+	content, err := json.MarshalIndent(savedFirewall{Backend: backend.String(), Policy: policy}, "", "  ")
+	AssertNoErr(err, "Could not serialize the firewall policy.")
+
+	WriteRemoteFile(client, firewallPolicyPath, append(content, '\n'), 0644)
+}
+
+func (p firewallPolicy) findRule(port int, protocol string) int {
+	for i, rule := range p.Rules {
+		if rule.Port == port && rule.Protocol == protocol {
+			return i
+		}
+	}
+	return -1
+}
+
+// Ports opened with 'snakeplant firewall allow' are kept when setup runs again, and ports that setup opened before but
+// wasn't told about this time are closed. If setup was told about the same port, what setup was told wins.
+//
+// Rules saved before their origin was recorded are kept, since there's no way to tell which ones are safe to close.
+// 'snakeplant firewall deny' closes them.
+func (p *firewallPolicy) mergeSavedRules(saved firewallPolicy) {
+	for _, rule := range saved.Rules {
+		if rule.From == ruleFromSetup {
+			continue
+		}
+		if p.findRule(rule.Port, rule.Protocol) == -1 {
+			p.Rules = append(p.Rules, rule)
+		}
+	}
+}
+
+func isWebPort(port int, protocol string) bool {
+	for _, webPort := range webPorts {
+		if port == webPort && protocol == "tcp" {
+			return true
+		}
+	}
+	return false
+}
+
+// No sources means open to everyone. Returns a description of what changed, or "" if nothing did.
+func (p *firewallPolicy) allow(port int, protocol string, sources []string) string {
+	if isWebPort(port, protocol) {
+		return ""
+	}
+
+	if port == p.SSHPort && protocol == "tcp" {
+		if len(sources) == 0 {
+			if len(p.SSHSources) == 0 {
+				return ""
+			}
+			p.SSHSources = nil
+			return "ssh is now open to everyone."
+		}
+		if len(p.SSHSources) == 0 {
+			PrintMessageAndQuit("ssh is already open to everyone. Run 'snakeplant setup --ssh-from' to restrict it.")
+		}
+		added := addSources(&p.SSHSources, sources)
+		if len(added) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("ssh is now also open to %v.", strings.Join(added, ", "))
+	}
+
+	i := p.findRule(port, protocol)
+	if i == -1 {
+		p.Rules = append(p.Rules, portRule{Port: port, Protocol: protocol, Sources: sources, From: ruleFromAllow})
+		return fmt.Sprintf("%v/%v is now open to %v.", port, protocol, describeSources(sources))
+	}
+
+	// Once it's been changed by hand, it's kept even if setup stops asking for it.
+	if len(sources) == 0 {
+		if len(p.Rules[i].Sources) == 0 {
+			return ""
+		}
+		p.Rules[i].Sources = nil
+		p.Rules[i].From = ruleFromAllow
+		return fmt.Sprintf("%v/%v is now open to everyone.", port, protocol)
+	}
+
+	if len(p.Rules[i].Sources) == 0 {
+		PrintMessageAndQuit(fmt.Sprintf("%v/%v is already open to everyone. Run 'snakeplant firewall deny %v/%v' first if you want to restrict it.", port, protocol, port, protocol))
+	}
+
+	added := addSources(&p.Rules[i].Sources, sources)
+	if len(added) == 0 {
+		return ""
+	}
+	p.Rules[i].From = ruleFromAllow
+	return fmt.Sprintf("%v/%v is now also open to %v.", port, protocol, strings.Join(added, ", "))
+}
+
+// No sources means close the port completely. Returns a description of what changed, or "" if nothing did.
+func (p *firewallPolicy) deny(port int, protocol string, sources []string) string {
+	if isWebPort(port, protocol) {
+		PrintMessageAndQuit(fmt.Sprintf("Ports %v are always open, since they're how your server serves web traffic.", joinPorts(webPorts)))
+	}
+
+	if port == p.SSHPort && protocol == "tcp" {
+		PrintMessageAndQuit("Closing ssh would lock you out. Run 'snakeplant setup --ssh-from' to change who can use it.")
+	}
+
+	i := p.findRule(port, protocol)
+	if i == -1 {
+		return ""
+	}
+
+	if len(sources) == 0 {
+		p.Rules = append(p.Rules[:i], p.Rules[i+1:]...)
+		return fmt.Sprintf("%v/%v is now closed.", port, protocol)
+	}
+
+	if len(p.Rules[i].Sources) == 0 {
+		PrintMessageAndQuit(fmt.Sprintf("%v/%v is open to everyone, so there's no source to take away. Run 'snakeplant firewall deny %v/%v' to close it.", port, protocol, port, protocol))
+	}
+
+	var remaining, removed []string
+	for _, existing := range p.Rules[i].Sources {
+		if containsString(sources, existing) {
+			removed = append(removed, existing)
+		} else {
+			remaining = append(remaining, existing)
+		}
+	}
+
+	if len(removed) == 0 {
+		return ""
+	}
+
+	// Leaving a rule with no sources would mean open to everyone, which is the opposite of what was asked for.
+	if len(remaining) == 0 {
+		p.Rules = append(p.Rules[:i], p.Rules[i+1:]...)
+		return fmt.Sprintf("%v/%v is now closed.", port, protocol)
+	}
+
+	p.Rules[i].Sources = remaining
+	return fmt.Sprintf("%v/%v is no longer open to %v.", port, protocol, strings.Join(removed, ", "))
+}
+
+func addSources(existing *[]string, sources []string) []string {
+	var added []string
+	for _, source := range sources {
+		if !containsString(*existing, source) {
+			*existing = append(*existing, source)
+			added = append(added, source)
+		}
+	}
+	return added
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+func describeSources(sources []string) string {
+	if len(sources) == 0 {
+		return "everyone"
+	}
+	return strings.Join(sources, ", ")
+}
+
+var wellKnownPorts = map[int]string{22: "ssh", 80: "http", 443: "https"}
+
+// Shared by every backend's explanation of the live rules, so they all read the same.
+func explainAllowedPorts(protocol, ports, source string) string {
+	var names []string
+	for _, port := range strings.Split(ports, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(port)); err == nil && wellKnownPorts[n] != "" && protocol == "tcp" {
+			names = append(names, fmt.Sprintf("%v (%v)", n, wellKnownPorts[n]))
+		} else {
+			names = append(names, strings.TrimSpace(port))
+		}
+	}
+
+	what := "connections"
+	if protocol == "udp" {
+		what = "traffic"
+	}
+
+	portWord := "port"
+	if len(names) > 1 {
+		portWord = "ports"
+	}
+
+	if source == "" {
+		source = "anywhere"
+	}
+	return fmt.Sprintf("Lets in %v %v to %v %v from %v.", strings.ToUpper(protocol), what, portWord, strings.Join(names, ", "), source)
+}
+
+const establishedExplanation = "Lets in replies to connections the server made, and the rest of any connection that was already let in. Without this, nothing the server downloads could get back to it."
+const loopbackExplanation = "Lets in traffic the server sends to itself, over the loopback ('lo') interface. Lots of programs talk to each other this way."
+const rejectExplanation = "Turns away everything that wasn't let in by a rule above it, and tells the sender that the port is closed."
+const rateLimitExplanation = "Drops new ssh connections from an address that's made more than %v of them in the last minute, until it slows down. 'snakeplant bans' shows and clears them."
+const neighborDiscoveryExplanation = "Lets in IPv6 neighbor discovery, which is how IPv6 does what ARP does for IPv4. Without it, IPv6 doesn't work at all."
+
+func printExplainedRule(rule, explanation string) {
+	fmt.Printf("%v%v\n", LINE_PADDING, rule)
+	PrintSubStepInformation(fmt.Sprintf("%v%v%v\n", LINE_PADDING, LINE_PADDING, explanation))
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewFirewallPolicy(t *testing.T) {
+	policy := newFirewallPolicy(2222, []string{"203.0.113.7", "2001:db8::1", "198.51.100.0/24"}, "8080, 5432@10.0.0.0/8,5432@192.168.1.7", "51820")
+
+	want := firewallPolicy{
+		SSHPort:    2222,
+		SSHSources: []string{"203.0.113.7/32", "2001:db8::1/128", "198.51.100.0/24"},
+		Rules: []portRule{
+			{Port: 8080, Protocol: "tcp", From: ruleFromSetup},
+			{Port: 5432, Protocol: "tcp", Sources: []string{"10.0.0.0/8", "192.168.1.7/32"}, From: ruleFromSetup},
+			{Port: 51820, Protocol: "udp", From: ruleFromSetup},
+		},
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("newFirewallPolicy() = %+v, want %+v", policy, want)
+	}
+}
+
+// What every policy starts and ends with, around the ssh and port rules.
+var (
+	iptablesV4Head = []string{
+		"-m state --state RELATED,ESTABLISHED -j ACCEPT",
+		"-p tcp -m state --state NEW -m tcp -m multiport --dports 80,443,444 -j ACCEPT",
+	}
+	iptablesV6Head = []string{
+		"-m state --state RELATED,ESTABLISHED -j ACCEPT",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 133 -j ACCEPT",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 134 -j ACCEPT",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 135 -j ACCEPT",
+		"-p ipv6-icmp -m icmp6 --icmpv6-type 136 -j ACCEPT",
+		"-p tcp -m state --state NEW -m tcp -m multiport --dports 80,443,444 -j ACCEPT",
+	}
+	iptablesV4Tail = []string{"-i lo -j ACCEPT", "-j REJECT --reject-with icmp-port-unreachable"}
+	iptablesV6Tail = []string{"-i lo -j ACCEPT", "-j REJECT --reject-with icmp6-port-unreachable"}
+
+	nftablesHead = []string{
+		"ct state established,related accept",
+		"icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept",
+		"tcp dport { 80, 443, 444 } ct state new accept",
+	}
+	nftablesTail = []string{`iifname "lo" accept`, "reject with icmpx type port-unreachable"}
+)
+
+func withHeadAndTail(head []string, rules []string, tail []string) []string {
+	var lines []string
+	lines = append(lines, head...)
+	lines = append(lines, rules...)
+	return append(lines, tail...)
+}
+
+func rateLimited(policy firewallPolicy, limit int) firewallPolicy {
+	policy.SSHRateLimit = limit
+	return policy
+}
+
+func TestFirewallRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   firewallPolicy
+		v4       []string
+		v6       []string
+		nftables []string
+	}{
+		{
+			name:     "ssh open to everyone",
+			policy:   newFirewallPolicy(22, nil, "", ""),
+			v4:       []string{"-p tcp -m tcp --dport 22 -j ACCEPT"},
+			v6:       []string{"-p tcp -m tcp --dport 22 -j ACCEPT"},
+			nftables: []string{"tcp dport 22 accept"},
+		},
+		{
+			// Restricted to IPv4 sources means closed on IPv6, not open to everyone there.
+			name:     "ssh from IPv4 only",
+			policy:   newFirewallPolicy(22, []string{"203.0.113.7", "198.51.100.0/24"}, "", ""),
+			v4:       []string{"-s 203.0.113.7/32 -p tcp -m tcp --dport 22 -j ACCEPT", "-s 198.51.100.0/24 -p tcp -m tcp --dport 22 -j ACCEPT"},
+			v6:       nil,
+			nftables: []string{"ip saddr 203.0.113.7/32 tcp dport 22 accept", "ip saddr 198.51.100.0/24 tcp dport 22 accept"},
+		},
+		{
+			name:     "ssh from IPv6 only",
+			policy:   newFirewallPolicy(2222, []string{"2001:db8::/32"}, "", ""),
+			v4:       nil,
+			v6:       []string{"-s 2001:db8::/32 -p tcp -m tcp --dport 2222 -j ACCEPT"},
+			nftables: []string{"ip6 saddr 2001:db8::/32 tcp dport 2222 accept"},
+		},
+		{
+			name:   "tcp and udp ports with sources in both families",
+			policy: newFirewallPolicy(22, nil, "8080,5432@10.0.0.0/8", "51820,53@2001:db8::53"),
+			v4: []string{
+				"-p tcp -m tcp --dport 22 -j ACCEPT",
+				"-p tcp -m tcp --dport 8080 -j ACCEPT",
+				"-s 10.0.0.0/8 -p tcp -m tcp --dport 5432 -j ACCEPT",
+				"-p udp -m udp --dport 51820 -j ACCEPT",
+			},
+			v6: []string{
+				"-p tcp -m tcp --dport 22 -j ACCEPT",
+				"-p tcp -m tcp --dport 8080 -j ACCEPT",
+				"-p udp -m udp --dport 51820 -j ACCEPT",
+				"-s 2001:db8::53/128 -p udp -m udp --dport 53 -j ACCEPT",
+			},
+			nftables: []string{
+				"tcp dport 22 accept",
+				"tcp dport 8080 accept",
+				"ip saddr 10.0.0.0/8 tcp dport 5432 accept",
+				"udp dport 51820 accept",
+				"ip6 saddr 2001:db8::53/128 udp dport 53 accept",
+			},
+		},
+		{
+			name:   "ssh rate limit",
+			policy: rateLimited(newFirewallPolicy(22, []string{"203.0.113.7"}, "", ""), 5),
+			v4: []string{
+				"-p tcp -m tcp --dport 22 -m state --state NEW -m recent --set --name snakeplant-ssh --rsource",
+				"-p tcp -m tcp --dport 22 -m state --state NEW -m recent --update --seconds 60 --hitcount 6 --name snakeplant-ssh --rsource -j DROP",
+				"-s 203.0.113.7/32 -p tcp -m tcp --dport 22 -j ACCEPT",
+			},
+			v6: []string{
+				"-p tcp -m tcp --dport 22 -m state --state NEW -m recent --set --name snakeplant-ssh --rsource",
+				"-p tcp -m tcp --dport 22 -m state --state NEW -m recent --update --seconds 60 --hitcount 6 --name snakeplant-ssh --rsource -j DROP",
+			},
+			nftables: []string{
+				"tcp dport 22 ct state new update @ssh_rate_ipv4 { ip saddr limit rate over 5/minute burst 5 packets } drop",
+				"tcp dport 22 ct state new update @ssh_rate_ipv6 { ip6 saddr limit rate over 5/minute burst 5 packets } drop",
+				"ip saddr 203.0.113.7/32 tcp dport 22 accept",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, want := test.policy.iptablesInputRules(ipv4), withHeadAndTail(iptablesV4Head, test.v4, iptablesV4Tail); !reflect.DeepEqual(got, want) {
+				t.Errorf("IPv4 rules:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			if got, want := test.policy.iptablesInputRules(ipv6), withHeadAndTail(iptablesV6Head, test.v6, iptablesV6Tail); !reflect.DeepEqual(got, want) {
+				t.Errorf("IPv6 rules:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			if got, want := test.policy.nftablesRules(), withHeadAndTail(nftablesHead, test.nftables, nftablesTail); !reflect.DeepEqual(got, want) {
+				t.Errorf("nftables rules:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestIptablesBootRules(t *testing.T) {
+	policy := newFirewallPolicy(22, []string{"2001:db8::/32"}, "", "")
+
+	want := `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:SNAKEPLANT-INPUT - [0:0]
+-A INPUT -j SNAKEPLANT-INPUT
+-A SNAKEPLANT-INPUT -m state --state RELATED,ESTABLISHED -j ACCEPT
+-A SNAKEPLANT-INPUT -p tcp -m state --state NEW -m tcp -m multiport --dports 80,443,444 -j ACCEPT
+-A SNAKEPLANT-INPUT -i lo -j ACCEPT
+-A SNAKEPLANT-INPUT -j REJECT --reject-with icmp-port-unreachable
+COMMIT
+`
+	if got := policy.iptablesBootRules(ipv4); got != want {
+		t.Errorf("iptablesBootRules(ipv4) =\n%v\nwant:\n%v", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"regexp"
+	"strings"
+)
+
+// cloud-init sets the hostname and rewrites /etc/hosts on every boot unless it's told not to.
+const cloudInitConfPath = "/etc/cloud/cloud.cfg.d/99-snakeplant.cfg"
+
+// RFC 1123: letters, digits and hyphens, not starting or ending with a hyphen, at most 63 characters per label.
+var hostnameLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Returns the fully qualified name and the short name. For a name without dots, they're the same.
+func parseHostname(name string) (string, string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if !hostnameLabelPattern.MatchString(label) {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' is not a valid hostname. Each part between dots can only have letters, digits and hyphens, and can't start or end with a hyphen.", name))
+		}
+	}
+	if len(name) > 253 {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is too long to be a hostname.", name))
+	}
+	return name, labels[0]
+}
+
+// Debian's convention is that the machine's own name resolves to 127.0.1.1, so that things like 'sudo' don't have to
+// wait on DNS. See https://www.debian.org/doc/manuals/debian-reference/ch05.en.html#_the_hostname_resolution
+func hostsWithHostname(current string, fqdn string, short string) string {
+	entry := fmt.Sprintf("127.0.1.1\t%v", fqdn)
+	if short != fqdn {
+		entry = fmt.Sprintf("%v %v", entry, short)
+	}
+
+	var lines []string
+	added := false
+	for _, line := range splitLines(current) {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "127.0.1.1" {
+			if !added {
+				lines = append(lines, entry)
+				added = true
+			}
+			continue
+		}
+
+		lines = append(lines, line)
+		if !added && len(fields) > 0 && fields[0] == "127.0.0.1" {
+			lines = append(lines, entry)
+			added = true
+		}
+	}
+	if !added {
+		lines = append([]string{entry}, lines...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func hostnameSteps(client *simplessh.Client, hostname string) []Step {
+	fqdn, short := parseHostname(hostname)
+
+	currentHostname := func() string {
+		out, err := client.Exec("hostnamectl --static 2>/dev/null || cat /etc/hostname")
+		AssertNoErr(err, "Could not get the hostname.")
+		return strings.TrimSpace(string(out))
+	}
+
+	steps := []Step{
+		{
+			Name:        "set-hostname",
+			Description: "Setting the hostname",
+			Inputs:      []string{short},
+			Check: func() bool {
+				return currentHostname() != short
+			},
+			Apply: func() {
+				PrintSubStepInformation(fmt.Sprintf("%vThe hostname is '%v', and should be '%v'.", LINE_PADDING, currentHostname(), short))
+				SSHCommand(client, fmt.Sprintf("hostnamectl set-hostname %v", short))
+			},
+		},
+		withDependencies(managedFileStep(client, "write-hosts", "Adding the hostname to /etc/hosts", managedFile{
+			path:  "/etc/hosts",
+			owner: "root:root",
+			mode:  0644,
+			render: func(current string) string {
+				return hostsWithHostname(current, fqdn, short)
+			},
+		}, fqdn), "set-hostname"),
+	}
+
+	_, err := client.Exec("[ -d /etc/cloud/cloud.cfg.d ]")
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check for cloud-init.")
+	if err == nil {
+		steps = append(steps, withDependencies(managedFileStep(client, "keep-hostname", "Stopping cloud-init from changing the hostname back", managedFile{
+			path:  cloudInitConfPath,
+			owner: "root:root",
+			mode:  0644,
+			render: func(string) string {
+				return "# Managed by snakeplant. 'snakeplant setup --hostname' sets these instead.\npreserve_hostname: true\nmanage_etc_hosts: false\n"
+			},
+		}), "write-hosts"))
+	}
+	return steps
+}
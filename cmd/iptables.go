@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// snakeplant's rules live in their own chain, which INPUT jumps to, so they can be replaced without touching anyone
+// else's.
+const iptablesChain = "SNAKEPLANT-INPUT"
+
+var iptablesJump = fmt.Sprintf("-j %v", iptablesChain)
+
+// The name of the 'recent' list that the ssh rate limit keeps addresses in. It shows up in /proc/net/xt_recent.
+const sshRateLimitName = "snakeplant-ssh"
+
+// IPv4 and IPv6 are filtered completely separately by the kernel, so each one needs its own set of rules.
+type ipFamily struct {
+	name         string
+	command      string
+	rulesFile    string
+	rejectWith   string
+	icmpProtocol string
+	// The ICMP types that have to be let in for the network to work at all.
+	requiredICMPTypes []string
+}
+
+var ipv4 = ipFamily{
+	name:         "IPv4",
+	command:      "iptables",
+	rulesFile:    "/etc/iptables/rules.v4",
+	rejectWith:   "icmp-port-unreachable",
+	icmpProtocol: "icmp",
+}
+
+var ipv6 = ipFamily{
+	name:         "IPv6",
+	command:      "ip6tables",
+	rulesFile:    "/etc/iptables/rules.v6",
+	rejectWith:   "icmp6-port-unreachable",
+	icmpProtocol: "ipv6-icmp",
+	// Neighbor discovery is how IPv6 does what ARP does for IPv4. Without it, the server can't even find its router.
+	// Router solicitation, router advertisement, neighbor solicitation, and neighbor advertisement, in that order.
+	requiredICMPTypes: []string{"133", "134", "135", "136"},
+}
+
+var ipFamilies = []ipFamily{ipv4, ipv6}
+
+func (f ipFamily) includes(source string) bool {
+	isIPv6 := strings.Contains(source, ":")
+	return isIPv6 == (f.name == ipv6.name)
+}
+
+// The rules that let a single port in, one per source since iptables only takes one source per rule.
+//
+// If a port is restricted to sources, but none of them are in this family, there are no rules at all. It's closed, not
+// open to everyone.
+func (f ipFamily) portRules(rule portRule) []string {
+	if len(rule.Sources) == 0 {
+		return []string{fmt.Sprintf("-p %v -m %v --dport %v -j ACCEPT", rule.Protocol, rule.Protocol, rule.Port)}
+	}
+
+	var lines []string
+	for _, source := range rule.Sources {
+		if f.includes(source) {
+			lines = append(lines, fmt.Sprintf("-s %v -p %v -m %v --dport %v -j ACCEPT", source, rule.Protocol, rule.Protocol, rule.Port))
+		}
+	}
+	return lines
+}
+
+// Renders the policy's chain in the format that 'iptables-save' writes and 'iptables-restore' reads. The chain has to
+// be declared before these, and declaring it empties it first, so loading them replaces every snakeplant rule at once.
+func (p firewallPolicy) iptablesChainRules(family ipFamily) string {
+	var lines []string
+	for _, rule := range p.iptablesInputRules(family) {
+		lines = append(lines, fmt.Sprintf("-A %v %v", iptablesChain, rule))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// What's loaded on boot. Nothing else has added rules yet at that point, so the whole table can be written out. Docker
+// and fail2ban add their own chains once they start.
+func (p firewallPolicy) iptablesBootRules(family ipFamily) string {
+	return "*filter\n" +
+		":INPUT ACCEPT [0:0]\n" +
+		":FORWARD ACCEPT [0:0]\n" +
+		":OUTPUT ACCEPT [0:0]\n" +
+		fmt.Sprintf(":%v - [0:0]\n", iptablesChain) +
+		fmt.Sprintf("-A INPUT %v\n", iptablesJump) +
+		p.iptablesChainRules(family) +
+		"COMMIT\n"
+}
+
+// The rules in snakeplant's chain, without the '-A <chain>' in front of them.
+func (p firewallPolicy) iptablesInputRules(family ipFamily) []string {
+	lines := []string{
+		"-m state --state RELATED,ESTABLISHED -j ACCEPT",
+	}
+
+	for _, icmpType := range family.requiredICMPTypes {
+		lines = append(lines, fmt.Sprintf("-p %v -m icmp6 --icmpv6-type %v -j ACCEPT", family.icmpProtocol, icmpType))
+	}
+
+	lines = append(lines, fmt.Sprintf("-p tcp -m state --state NEW -m tcp -m multiport --dports %v -j ACCEPT", joinPorts(webPorts)))
+
+	if p.SSHRateLimit > 0 {
+		// 'recent' remembers every new connection's address, and then counts how many it made in the last minute.
+		// --hitcount counts the connection being made too, so it's one more than the connections that are allowed.
+		lines = append(lines,
+			fmt.Sprintf("-p tcp -m tcp --dport %v -m state --state NEW -m recent --set --name %v --rsource", p.SSHPort, sshRateLimitName),
+			fmt.Sprintf("-p tcp -m tcp --dport %v -m state --state NEW -m recent --update --seconds 60 --hitcount %v --name %v --rsource -j DROP", p.SSHPort, p.SSHRateLimit+1, sshRateLimitName),
+		)
+	}
+
+	lines = append(lines, family.portRules(portRule{Port: p.SSHPort, Protocol: "tcp", Sources: p.SSHSources})...)
+	for _, rule := range p.Rules {
+		lines = append(lines, family.portRules(rule)...)
+	}
+
+	lines = append(lines,
+		"-i lo -j ACCEPT",
+		fmt.Sprintf("-j REJECT --reject-with %v", family.rejectWith),
+	)
+	return lines
+}
+
+// '--noflush' only replaces snakeplant's chain. Everything else in the filter table, like Docker's chains and
+// fail2ban's, is left alone, so containers keep their networking.
+//
+// Before snakeplant had its own chain, its rules went straight into INPUT, and they'd reject everything before the
+// jump was reached. So the first time INPUT doesn't have the jump, it's emptied before the jump is added. That takes
+// out fail2ban's jump too, so fail2ban is restarted to put it back. 'try-restart' does nothing if it isn't running.
+func (p firewallPolicy) restoreCommand(family ipFamily) string {
+	return fmt.Sprintf("%v-restore --noflush <<-'EOF'\n*filter\n:%v - [0:0]\n%vCOMMIT\nEOF\n", family.command, iptablesChain, p.iptablesChainRules(family)) +
+		fmt.Sprintf("%v -C INPUT %v 2>/dev/null || { %v -F INPUT && %v -A INPUT %v && systemctl try-restart fail2ban; }", family.command, iptablesJump, family.command, family.command, iptablesJump)
+}
+
+// Returns the rules that should be loaded but aren't. 'iptables -C' checks for a rule without changing anything.
+func (p firewallPolicy) missingRules(client *simplessh.Client, family ipFamily) []string {
+	var missing []string
+	_, err := client.Exec(fmt.Sprintf("%v -C INPUT %v", family.command, iptablesJump))
+	AssertAnyErrWasDueToNonZeroExitCode(err, fmt.Sprintf("Interrupted while checking the %v firewall rules.", family.name))
+	if err != nil {
+		missing = append(missing, fmt.Sprintf("-A INPUT %v", iptablesJump))
+	}
+
+	for _, rule := range p.iptablesInputRules(family) {
+		_, err := client.Exec(fmt.Sprintf("%v -C %v %v", family.command, iptablesChain, rule))
+		AssertAnyErrWasDueToNonZeroExitCode(err, fmt.Sprintf("Interrupted while checking the %v firewall rules.", family.name))
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("-A %v %v", iptablesChain, rule))
+		}
+	}
+	return missing
+}
+
+// Loads rules with 'iptables-restore' and uses iptables-persistent to load them again on boot.
+type iptablesBackend struct{}
+
+func (iptablesBackend) String() string {
+	return "iptables"
+}
+
+func (iptablesBackend) packages(target platform) []aptPackage {
+	return []aptPackage{{
+		name: target.packageName("iptables-persistent"),
+		// Otherwise it asks whether to save the rules that are loaded right now, and the install hangs.
+		debconf: []string{
+			"iptables-persistent iptables-persistent/autosave_v4 boolean true",
+			"iptables-persistent iptables-persistent/autosave_v6 boolean true",
+		},
+	}}
+}
+
+func (iptablesBackend) installSteps(*simplessh.Client, platform) []Step {
+	return nil
+}
+
+// Only INPUT and snakeplant's chain are saved and put back, since those are the only ones load changes. Putting back the
+// whole table would undo whatever Docker did to its chains in the meantime.
+func (iptablesBackend) snapshot(client *simplessh.Client, dir string) string {
+	var restoreCommands []string
+	for _, family := range ipFamilies {
+		rollbackFile := fmt.Sprintf("%v/rollback.%v", dir, family.command)
+		SSHCommand(client, fmt.Sprintf("{ echo '*filter'; echo ':%v - [0:0]'; %v -S %v 2>/dev/null | grep -e '^-A'; %v -S INPUT | grep -e '^-A'; echo COMMIT; } > %v", iptablesChain, family.command, iptablesChain, family.command, rollbackFile))
+		restoreCommands = append(restoreCommands, fmt.Sprintf("%v -F INPUT && %v-restore --noflush < %v", family.command, family.command, rollbackFile))
+	}
+	return strings.Join(restoreCommands, "; ")
+}
+
+func (iptablesBackend) load(client *simplessh.Client, policy firewallPolicy) {
+	for _, family := range ipFamilies {
+		SSHCommand(client, policy.restoreCommand(family))
+	}
+}
+
+// The rules file is written from the policy instead of 'iptables-save', so Docker's and fail2ban's chains, which they
+// add again every time they start, don't get loaded on boot as well.
+func (iptablesBackend) persist(client *simplessh.Client, policy firewallPolicy) {
+	for _, family := range ipFamilies {
+		WriteRemoteFile(client, family.rulesFile, []byte(policy.iptablesBootRules(family)), 0644)
+	}
+	for i, family := range ipFamilies {
+		if i > 0 {
+			fmt.Println()
+		}
+		PrintSubStepInformation(fmt.Sprintf("%v%v firewall rules:", LINE_PADDING, family.name))
+		SSHCommand(client, fmt.Sprintf("cat %v", family.rulesFile))
+	}
+}
+
+func (iptablesBackend) missingRules(client *simplessh.Client, policy firewallPolicy) []string {
+	var missing []string
+	for _, family := range ipFamilies {
+		for _, rule := range policy.missingRules(client, family) {
+			missing = append(missing, fmt.Sprintf("%v: %v", family.name, rule))
+		}
+	}
+	return missing
+}
+
+// 'recent' lists every address it remembers in /proc, one per line, like 'src=203.0.113.7 ttl: 52 last_seen: ...'.
+// IPv4 and IPv6 addresses end up in the same list.
+func (iptablesBackend) rateLimitedSources(client *simplessh.Client) []string {
+	out, err := client.Exec(fmt.Sprintf("cat /proc/net/xt_recent/%v 2>/dev/null; true", sshRateLimitName))
+	AssertNoErr(err, "Could not read the ssh rate limit's list of addresses.")
+
+	var sources []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "src=") {
+			sources = append(sources, strings.TrimPrefix(fields[0], "src="))
+		}
+	}
+	return sources
+}
+
+func (b iptablesBackend) clearRateLimit(client *simplessh.Client, ip net.IP) bool {
+	for _, source := range b.rateLimitedSources(client) {
+		if tracked := net.ParseIP(source); tracked != nil && tracked.Equal(ip) {
+			SSHCommand(client, fmt.Sprintf("echo -%v > /proc/net/xt_recent/%v", ip, sshRateLimitName))
+			return true
+		}
+	}
+	return false
+}
+
+func (iptablesBackend) explainLiveRules(client *simplessh.Client) {
+	for i, family := range ipFamilies {
+		if i > 0 {
+			fmt.Println()
+		}
+		PrintSubStepInformation(fmt.Sprintf("%v rules ('%v -S INPUT' and '%v -S %v'):", family.name, family.command, family.command, iptablesChain))
+
+		out, err := client.Exec(fmt.Sprintf("%v -S INPUT; %v -S %v 2>/dev/null; true", family.command, family.command, iptablesChain))
+		AssertNoErr(err, fmt.Sprintf("Could not list the %v firewall rules.", family.name))
+
+		for _, rule := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			printExplainedRule(rule, explainIptablesRule(rule))
+		}
+	}
+}
+
+func explainIptablesRule(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) == 2 && fields[0] == "-N" && fields[1] == iptablesChain {
+		return "snakeplant's own chain. Every rule below this one is in it."
+	}
+	if len(fields) == 3 && fields[0] == "-P" {
+		return fmt.Sprintf("If none of the rules below match, the packet is handled with %v. The last rule should always match, so this never actually happens.", fields[2])
+	}
+
+	// Every option that iptables prints takes at most one value, so pairing them up is enough to pick rules apart.
+	options := map[string]string{}
+	for i := 0; i < len(fields); i++ {
+		if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+			options[fields[i]] = fields[i+1]
+			i++
+		} else {
+			options[fields[i]] = ""
+		}
+	}
+
+	target := options["-j"]
+	state := options["--state"] + options["--ctstate"]
+
+	switch {
+	case target == iptablesChain:
+		return fmt.Sprintf("Sends everything coming in to snakeplant's rules in the %v chain.", iptablesChain)
+	case target == "DROP" && options["--name"] == sshRateLimitName:
+		hits, _ := strconv.Atoi(options["--hitcount"])
+		return fmt.Sprintf(rateLimitExplanation, hits-1)
+	case target == "" && options["--name"] == sshRateLimitName:
+		return "Remembers the address of every new ssh connection, so the rule below can count them."
+	case target == "REJECT" && len(options) <= 3:
+		return rejectExplanation
+	case target == "ACCEPT" && options["-i"] == "lo":
+		return loopbackExplanation
+	case target == "ACCEPT" && strings.Contains(state, "ESTABLISHED"):
+		return establishedExplanation
+	case target == "ACCEPT" && options["--icmpv6-type"] != "":
+		return neighborDiscoveryExplanation
+	case target == "ACCEPT" && options["--dport"] != "":
+		return explainAllowedPorts(options["-p"], options["--dport"], options["-s"])
+	case target == "ACCEPT" && options["--dports"] != "":
+		return explainAllowedPorts(options["-p"], options["--dports"], options["-s"])
+	}
+	return "snakeplant didn't add this rule, so it can't explain it. 'man iptables' and 'man iptables-extensions' describe every option."
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A file on the server that snakeplant decides the content of. Instead of editing the file in place, the whole
+// content it should have is rendered here and compared against what's there, so an edit can never silently do nothing
+// because the distribution changed its defaults.
+type managedFile struct {
+	path string
+	// Like 'root:root'.
+	owner string
+	mode  os.FileMode
+	// Returns what the file should contain. current is what's in it now, or "" if it doesn't exist. Drop-in files that
+	// snakeplant owns completely can ignore it.
+	render func(current string) string
+	// Optional. Gets a copy of the rendered file somewhere else on the server, and quits if it isn't right, before the
+	// real file is touched.
+	validate func(client *simplessh.Client, stagedPath string)
+}
+
+func readRemoteFile(client *simplessh.Client, filePath string) (string, bool) {
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", filePath))
+	AssertAnyErrWasDueToNonZeroExitCode(err, fmt.Sprintf("Interrupted while checking if %v exists.", filePath))
+	if err != nil {
+		return "", false
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", filePath))
+	AssertNoErr(err, fmt.Sprintf("Could not read %v.", filePath))
+	return string(out), true
+}
+
+func (f managedFile) ownerAndMode() string {
+	return fmt.Sprintf("%v %o", f.owner, f.mode)
+}
+
+// Whether anything about the file (content, owner or mode) is different than it should be.
+func (f managedFile) needsChange(client *simplessh.Client) bool {
+	current, exists := readRemoteFile(client, f.path)
+	if !exists {
+		return true
+	}
+
+	if sha256.Sum256([]byte(current)) != sha256.Sum256([]byte(f.render(current))) {
+		return true
+	}
+
+	out, err := client.Exec(fmt.Sprintf("stat -c '%%U:%%G %%a' %v", f.path))
+	AssertNoErr(err, fmt.Sprintf("Could not check the owner and mode of %v.", f.path))
+	return strings.TrimSpace(string(out)) != f.ownerAndMode()
+}
+
+// What apply would do to the content, as a unified diff.
+func (f managedFile) pendingDiff(client *simplessh.Client) string {
+	current, _ := readRemoteFile(client, f.path)
+	return unifiedDiff(f.path+" (before)", f.path+" (after)", current, f.render(current))
+}
+
+// Writes the rendered content, after backing up what was there. Backups end in '.bak' so apt and friends ignore them
+// when they're next to the original in a '.d' directory.
+func (f managedFile) apply(client *simplessh.Client) {
+	current, exists := readRemoteFile(client, f.path)
+	desired := f.render(current)
+
+	if f.validate != nil {
+		out, err := client.Exec("mktemp")
+		AssertNoErr(err, "Could not create temp file.")
+
+		stagedPath := strings.TrimSpace(string(out))
+		WriteRemoteFile(client, stagedPath, []byte(desired), f.mode)
+		f.validate(client, stagedPath)
+		SSHCommand(client, fmt.Sprintf("rm -f %v", stagedPath))
+	}
+
+	if exists {
+		backupPath := fmt.Sprintf("%v.snakeplant-%v.bak", f.path, time.Now().UTC().Format("20060102T150405Z"))
+		SSHCommand(client, fmt.Sprintf("cp -p %v %v", f.path, backupPath))
+		PrintSubStepInformation(fmt.Sprintf("%vThe old %v was backed up to %v.", LINE_PADDING, f.path, backupPath))
+	}
+
+	SSHCommand(client, fmt.Sprintf("mkdir -p %v", path.Dir(f.path)))
+	WriteRemoteFile(client, f.path, []byte(desired), f.mode)
+	SSHCommand(client, fmt.Sprintf("chown %v %v", f.owner, f.path))
+
+	diff := unifiedDiff(f.path+" (before)", f.path+" (after)", current, desired)
+	if diff == "" {
+		PrintSubStepInformation(fmt.Sprintf("%vOnly the owner or mode of %v changed. It's now %v.", LINE_PADDING, f.path, f.ownerAndMode()))
+		return
+	}
+	printUnifiedDiff(diff)
+}
+
+// A step that makes the file look the way it's rendered.
+func managedFileStep(client *simplessh.Client, name string, description string, file managedFile, inputs ...string) Step {
+	return Step{
+		Name:        name,
+		Description: description,
+		Inputs:      append([]string{file.path, file.ownerAndMode()}, inputs...),
+		Check: func() bool {
+			return file.needsChange(client)
+		},
+		Diff: func() string {
+			return file.pendingDiff(client)
+		},
+		Apply: func() {
+			file.apply(client)
+		},
+	}
+}
@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const nftablesConfPath = "/etc/nftables.conf"
+
+// Everything snakeplant does lives in its own table, so it never touches rules that something else (like docker) added.
+const nftablesTable = "inet snakeplant"
+
+// Loads rules with 'nft' and uses nftables.service to load them again on boot. An 'inet' table handles IPv4 and IPv6
+// together, so unlike iptables there's only one set of rules.
+type nftablesBackend struct{}
+
+func (nftablesBackend) String() string {
+	return "nftables"
+}
+
+func nftablesSourceMatch(source string) string {
+	if ipv6.includes(source) {
+		return fmt.Sprintf("ip6 saddr %v ", source)
+	}
+	return fmt.Sprintf("ip saddr %v ", source)
+}
+
+func nftablesPortRules(rule portRule) []string {
+	if len(rule.Sources) == 0 {
+		return []string{fmt.Sprintf("%v dport %v accept", rule.Protocol, rule.Port)}
+	}
+
+	var lines []string
+	for _, source := range rule.Sources {
+		lines = append(lines, fmt.Sprintf("%v%v dport %v accept", nftablesSourceMatch(source), rule.Protocol, rule.Port))
+	}
+	return lines
+}
+
+// Sets only hold one kind of address, so IPv4 and IPv6 each need their own.
+var nftablesRateLimitSets = []struct {
+	set, match, addressType string
+}{
+	{"ssh_rate_ipv4", "ip", "ipv4_addr"},
+	{"ssh_rate_ipv6", "ip6", "ipv6_addr"},
+}
+
+// An address is forgotten once it hasn't made a new ssh connection for a few minutes, so the sets don't grow forever.
+func (p firewallPolicy) nftablesSets() string {
+	if p.SSHRateLimit == 0 {
+		return ""
+	}
+	var sets []string
+	for _, family := range nftablesRateLimitSets {
+		sets = append(sets, fmt.Sprintf("set %v {\n\t\ttype %v\n\t\tflags dynamic,timeout\n\t\ttimeout 5m\n\t}\n\n\t", family.set, family.addressType))
+	}
+	return strings.Join(sets, "")
+}
+
+func (p firewallPolicy) nftablesRules() []string {
+	webPortStrs := make([]string, len(webPorts))
+	for i, port := range webPorts {
+		webPortStrs[i] = strconv.Itoa(port)
+	}
+
+	lines := []string{
+		"ct state established,related accept",
+		// Same as the IPv6 rules for iptables, without neighbor discovery the server can't even find its router.
+		"icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert } accept",
+		fmt.Sprintf("tcp dport { %v } ct state new accept", strings.Join(webPortStrs, ", ")),
+	}
+
+	if p.SSHRateLimit > 0 {
+		// Each address gets its own limit in the set. The burst lets that many connections through back to back.
+		for _, family := range nftablesRateLimitSets {
+			lines = append(lines, fmt.Sprintf("tcp dport %v ct state new update @%v { %v saddr limit rate over %v/minute burst %v packets } drop", p.SSHPort, family.set, family.match, p.SSHRateLimit, p.SSHRateLimit))
+		}
+	}
+
+	lines = append(lines, nftablesPortRules(portRule{Port: p.SSHPort, Protocol: "tcp", Sources: p.SSHSources})...)
+	for _, rule := range p.Rules {
+		lines = append(lines, nftablesPortRules(rule)...)
+	}
+
+	lines = append(lines,
+		`iifname "lo" accept`,
+		"reject with icmpx type port-unreachable",
+	)
+	return lines
+}
+
+// The empty 'table' followed by 'delete table' is the usual trick for making the file safe to load more than once:
+// the table always exists by the time it's deleted, and the new one replaces it in the same transaction.
+func (p firewallPolicy) nftablesConf() string {
+	return fmt.Sprintf(`#!/usr/sbin/nft -f
+# Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs.
+
+table %v
+delete table %v
+
+table %v {
+	%vchain input {
+		type filter hook input priority 0; policy accept;
+		%v
+	}
+}
+`, nftablesTable, nftablesTable, nftablesTable, p.nftablesSets(), strings.Join(p.nftablesRules(), "\n\t\t"))
+}
+
+func (nftablesBackend) packages(target platform) []aptPackage {
+	return []aptPackage{{name: target.packageName("nftables")}}
+}
+
+func (nftablesBackend) installSteps(client *simplessh.Client, target platform) []Step {
+	return []Step{
+		{
+			Name:        "check-iptables-persistent",
+			Description: "Checking for iptables-persistent",
+			DependsOn:   []string{"install-packages"},
+			AlwaysRun:   true,
+			Check: func() bool {
+				return packageInstalled(client, "iptables-persistent")
+			},
+			Apply: func() {
+				// We don't remove it ourselves, since it could be holding rules that someone cares about.
+				color.Yellow("%viptables-persistent is installed, and will load its own rules on boot on top of nftables. If you don't need it anymore, remove it with 'apt-get purge iptables-persistent'.", LINE_PADDING)
+			},
+		},
+	}
+}
+
+func (nftablesBackend) snapshot(client *simplessh.Client, dir string) string {
+	rollbackFile := fmt.Sprintf("%v/rollback.nft", dir)
+	SSHCommand(client, fmt.Sprintf("{ echo 'flush ruleset'; nft list ruleset; } > %v", rollbackFile))
+	return fmt.Sprintf("nft -f %v", rollbackFile)
+}
+
+func (nftablesBackend) load(client *simplessh.Client, policy firewallPolicy) {
+	// Not straight into /etc/nftables.conf, so if the rules get rolled back, a reboot doesn't bring them back.
+	stagedFile := fmt.Sprintf("%v/snakeplant.nft", firewallStateDir)
+	WriteRemoteFile(client, stagedFile, []byte(policy.nftablesConf()), 0644)
+	SSHCommand(client, fmt.Sprintf("nft -f %v", stagedFile))
+}
+
+func (nftablesBackend) persist(client *simplessh.Client, policy firewallPolicy) {
+	safeIdempotentCopyFile(client, nftablesConfPath, fmt.Sprintf("%v.bak", nftablesConfPath))
+	WriteRemoteFile(client, nftablesConfPath, []byte(policy.nftablesConf()), 0755)
+	SSHCommand(client, "systemctl enable nftables.service")
+
+	PrintSubStepInformation(fmt.Sprintf("%vnftables rules:", LINE_PADDING))
+	SSHCommand(client, fmt.Sprintf("nft list table %v", nftablesTable))
+}
+
+// nft prints rules back differently than they were written (sets get reformatted, '/32' is dropped, and so on), so
+// comparing text isn't reliable. Instead this makes sure the table is there and has the right number of rules in it.
+func (nftablesBackend) missingRules(client *simplessh.Client, policy firewallPolicy) []string {
+	out, err := client.Exec(fmt.Sprintf("nft -a list chain %v input", nftablesTable))
+	if err != nil {
+		return []string{fmt.Sprintf("the whole '%v' table", nftablesTable)}
+	}
+
+	loaded := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.Contains(line, "# handle") && !strings.HasPrefix(line, "chain ") && !strings.HasPrefix(line, "table ") {
+			loaded++
+		}
+	}
+
+	expected := policy.nftablesRules()
+	if loaded != len(expected) {
+		return []string{fmt.Sprintf("%v rules in '%v', but there are %v loaded. Expected:\n%v%v", len(expected), nftablesTable, loaded, LINE_PADDING, strings.Join(expected, "\n"+LINE_PADDING))}
+	}
+	return nil
+}
+
+// 'nft list set' prints the addresses like 'elements = { 203.0.113.7 limit rate over 6/minute burst 6 packets expires 4m12s, ... }'.
+func (nftablesBackend) rateLimitedSources(client *simplessh.Client) []string {
+	var sources []string
+	for _, family := range nftablesRateLimitSets {
+		out, err := client.Exec(fmt.Sprintf("nft list set %v %v", nftablesTable, family.set))
+		if err != nil {
+			// The rate limit isn't on.
+			continue
+		}
+		_, elements, found := strings.Cut(string(out), "elements = {")
+		if !found {
+			continue
+		}
+		elements, _, _ = strings.Cut(elements, "}")
+		for _, element := range strings.Split(elements, ",") {
+			if fields := strings.Fields(element); len(fields) > 0 {
+				sources = append(sources, fields[0])
+			}
+		}
+	}
+	return sources
+}
+
+func (b nftablesBackend) clearRateLimit(client *simplessh.Client, ip net.IP) bool {
+	for _, source := range b.rateLimitedSources(client) {
+		if tracked := net.ParseIP(source); tracked != nil && tracked.Equal(ip) {
+			set := nftablesRateLimitSets[0].set
+			if ip.To4() == nil {
+				set = nftablesRateLimitSets[1].set
+			}
+			SSHCommand(client, fmt.Sprintf("nft delete element %v %v { %v }", nftablesTable, set, ip))
+			return true
+		}
+	}
+	return false
+}
+
+func (nftablesBackend) explainLiveRules(client *simplessh.Client) {
+	PrintSubStepInformation(fmt.Sprintf("Rules in the '%v' table ('nft list chain %v input'):", nftablesTable, nftablesTable))
+
+	out, err := client.Exec(fmt.Sprintf("nft list chain %v input", nftablesTable))
+	AssertNoErr(err, fmt.Sprintf("Could not list the '%v' firewall rules.", nftablesTable))
+
+	for _, line := range strings.Split(string(out), "\n") {
+		rule := strings.TrimSpace(line)
+		if rule == "" || rule == "}" || strings.HasPrefix(rule, "table ") || strings.HasPrefix(rule, "chain ") {
+			continue
+		}
+		printExplainedRule(rule, explainNftablesRule(rule))
+	}
+}
+
+func explainNftablesRule(rule string) string {
+	fields := strings.Fields(rule)
+	valueAfter := func(keyword string) string {
+		for i, field := range fields {
+			if field == keyword && i+1 < len(fields) {
+				// Sets like '{ 80, 443 }' are spread across several fields.
+				if fields[i+1] == "{" {
+					var values []string
+					for _, value := range fields[i+2:] {
+						if value == "}" {
+							break
+						}
+						values = append(values, strings.TrimSuffix(value, ","))
+					}
+					return strings.Join(values, ",")
+				}
+				return fields[i+1]
+			}
+		}
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(rule, "type filter hook input"):
+		return "Makes this chain see every packet coming into the server. 'policy accept' means anything the rules below don't match is let in, but the last rule matches everything."
+	case strings.HasPrefix(rule, "reject"):
+		return rejectExplanation
+	case strings.Contains(rule, `iifname "lo"`) && strings.HasSuffix(rule, "accept"):
+		return loopbackExplanation
+	case strings.Contains(rule, "ct state") && strings.Contains(rule, "established") && strings.HasSuffix(rule, "accept"):
+		return establishedExplanation
+	case strings.HasPrefix(rule, "icmpv6 type") && strings.HasSuffix(rule, "accept"):
+		return neighborDiscoveryExplanation
+	case strings.Contains(rule, "limit rate over") && strings.HasSuffix(rule, "drop"):
+		perMinute, _, _ := strings.Cut(valueAfter("over"), "/")
+		return fmt.Sprintf(rateLimitExplanation, perMinute)
+	case strings.Contains(rule, "dport ") && strings.HasSuffix(rule, "accept"):
+		protocol := "tcp"
+		if strings.Contains(rule, "udp dport") {
+			protocol = "udp"
+		}
+		return explainAllowedPorts(protocol, valueAfter("dport"), valueAfter("saddr"))
+	}
+	return "snakeplant didn't add this rule, so it can't explain it. 'man nft' describes every part of it."
+}
@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	packPath = "/usr/local/bin/pack"
+	// What 'pack rollback' puts back.
+	previousPackPath = "/usr/local/bin/pack.previous"
+	// What setup installs, unless told otherwise.
+	defaultPackVersion = "0.28.0"
+)
+
+type packArtifact struct {
+	version  string
+	fileName string
+	tarSha   string
+	// Empty when we don't have a hash of the binary inside the tarball that we've checked ourselves. See packShaPath.
+	binSha string
+}
+
+func (a packArtifact) url() string {
+	return fmt.Sprintf("https://github.com/buildpacks/pack/releases/download/v%v/%v", a.version, a.fileName)
+}
+
+// Every pack release snakeplant can install, by version and then by architecture. pack is a static binary, so the
+// same download works on every supported OS. To add a release, take the sha256 of each tarball from the release's
+// '.sha256' files and check it against a download of your own.
+var packReleases = map[string]map[string]packArtifact{
+	"0.28.0": {
+		"amd64": {
+			version:  "0.28.0",
+			fileName: "pack-v0.28.0-linux.tgz",
+			tarSha:   "4f51b82dea355cffc62b7588a2dfa461e26621dda3821034830702e5cae6f587",
+			binSha:   "01b42a9125418ff46e7ed06ccdc38f9f28e6c0d31e07a39791cf633f8ec5e6e0",
+		},
+		"arm64": {
+			version:  "0.28.0",
+			fileName: "pack-v0.28.0-linux-arm64.tgz",
+			tarSha:   "f4940962d1d65b3abcb1996e98cae6497f525999991e9d9dbc7d78a4029d5bb6",
+		},
+	},
+}
+
+func packVersions() []string {
+	var versions []string
+	for version := range packReleases {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Every architecture's artifact for the version.
+func findPackRelease(version string) map[string]packArtifact {
+	version = strings.TrimPrefix(version, "v")
+	artifacts, ok := packReleases[version]
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("snakeplant doesn't know the checksums for pack %v, so it can't install it. It knows: %v.", version, strings.Join(packVersions(), ", ")))
+	}
+	return artifacts
+}
+
+func findPackArtifact(version string, arch string) packArtifact {
+	version = strings.TrimPrefix(version, "v")
+	artifact, ok := findPackRelease(version)[arch]
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("snakeplant doesn't know the checksums for pack %v on %v.", version, arch))
+	}
+	return artifact
+}
+
+func packBinarySha(client *simplessh.Client, binaryPath string) string {
+	out, err := client.Exec(fmt.Sprintf("sha256sum %v | awk '{print $1}'", binaryPath))
+	AssertNoErr(err, fmt.Sprintf("Could not check the hash of %v.", binaryPath))
+	return strings.TrimSpace(string(out))
+}
+
+// The hash of the binary that came out of the checked tarball is written next to it when it's installed. For releases
+// where we don't know the binary's hash ourselves, that's what it's checked against later.
+func packShaPath(binaryPath string) string {
+	return binaryPath + ".sha256"
+}
+
+func packReportsVersion(client *simplessh.Client, binaryPath string, pack packArtifact) bool {
+	out, err := client.Exec(fmt.Sprintf("%v version", binaryPath))
+	return err == nil && strings.HasPrefix(strings.TrimSpace(string(out)), pack.version)
+}
+
+// Is the installed pack binary at binaryPath the one that came out of this release?
+func packMatches(client *simplessh.Client, binaryPath string, pack packArtifact) bool {
+	sha := packBinarySha(client, binaryPath)
+	if pack.binSha != "" {
+		return sha == pack.binSha
+	}
+
+	// The version alone isn't enough, since any build of pack can say it's this one. One installed before the hash was
+	// recorded doesn't match, so it's installed again.
+	recorded, ok := readRemoteFile(client, packShaPath(binaryPath))
+	return ok && strings.TrimSpace(recorded) == sha && packReportsVersion(client, binaryPath, pack)
+}
+
+// Returns the version of the installed pack, if it's one of the releases snakeplant knows about and it's intact.
+func installedPackVersion(client *simplessh.Client, arch string) (string, bool) {
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", packPath))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check if 'pack' already exists.")
+	if err != nil {
+		return "", false
+	}
+
+	for _, version := range packVersions() {
+		if artifact, ok := packReleases[version][arch]; ok && packMatches(client, packPath, artifact) {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// Downloads and checks the release, then swaps it in with a rename, so there's never a moment without a working pack.
+// Whatever was installed before is kept at previousPackPath. If the tarball was uploaded from an artifact cache,
+// cachedTarball is where it is, and nothing is downloaded.
+func installPack(client *simplessh.Client, pack packArtifact, cachedTarball string) {
+	out, err := client.Exec("mktemp -d")
+	AssertNoErr(err, "Could not create temp directory.")
+	dir := strings.TrimSpace(string(out))
+	defer client.Exec(fmt.Sprintf("rm -rf %v", dir))
+
+	tarball := fmt.Sprintf("%v/%v", dir, pack.fileName)
+	if cachedTarball != "" {
+		SSHCommand(client, fmt.Sprintf("cp %v %v", cachedTarball, tarball))
+	} else {
+		curlCommand(client, fmt.Sprintf("-m 60 -o %v -f -L --progress-bar %v", tarball, pack.url()))
+	}
+
+	out, err = client.Exec(fmt.Sprintf("sha256sum %v | awk '{print $1}'", tarball))
+	AssertNoErr(err, "Could not get hash of pack-cli tarball.")
+	if strings.TrimSpace(string(out)) != pack.tarSha {
+		PrintMessageAndQuit("'pack-cli' tarball is corrupt, or someone is doing something sneaky.")
+	}
+
+	_, err = client.Exec(fmt.Sprintf("tar -xzf %v -C %v pack", tarball, dir))
+	AssertNoErr(err, "Could not un-tar pack.")
+	extracted := fmt.Sprintf("%v/pack", dir)
+	sha := packBinarySha(client, extracted)
+	// Without a known hash of the binary, the best we can do is make sure it's the version we expect. The tarball it
+	// came out of was still checked above.
+	if (pack.binSha != "" && sha != pack.binSha) || (pack.binSha == "" && !packReportsVersion(client, extracted, pack)) {
+		PrintMessageAndQuit(fmt.Sprintf("The pack binary in %v isn't the one that should be in there.", pack.fileName))
+	}
+
+	_, err = client.Exec(fmt.Sprintf("[ -f %v ]", packPath))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check if 'pack' already exists.")
+	if err == nil {
+		SSHCommand(client, fmt.Sprintf("cp -p %v %v && { cp -p %v %v 2>/dev/null || rm -f %v; }",
+			packPath, previousPackPath, packShaPath(packPath), packShaPath(previousPackPath), packShaPath(previousPackPath)))
+	}
+
+	WriteRemoteFile(client, packShaPath(packPath), []byte(sha+"\n"), 0644)
+	// The new binary is put next to the old one first, since 'mv' is only atomic within the same filesystem.
+	SSHCommand(client, fmt.Sprintf("install -m 0755 %v %v.new && mv -f %v.new %v", extracted, packPath, packPath, packPath))
+}
+
+func packInstallStep(client *simplessh.Client, target platform, version string) Step {
+	// Without '--pack-version', a version that 'snakeplant pack upgrade' installed is kept instead of being downgraded.
+	wanted := func() string {
+		if version != "" {
+			return version
+		}
+		if installed, ok := installedPackVersion(client, target.arch); ok {
+			return installed
+		}
+		return defaultPackVersion
+	}
+
+	return Step{
+		Name:        "install-pack",
+		Description: "Installing pack",
+		DependsOn:   []string{"install-packages"},
+		Inputs:      []string{target.arch, version},
+		Check: func() bool {
+			installed, ok := installedPackVersion(client, target.arch)
+			return !ok || installed != wanted()
+		},
+		Apply: func() {
+			pack := findPackArtifact(wanted(), target.arch)
+			if installed, ok := installedPackVersion(client, target.arch); ok {
+				PrintSubStepInformation(fmt.Sprintf("%vpack %v is installed, and should be %v.", LINE_PADDING, installed, pack.version))
+			} else {
+				PrintSubStepInformation(fmt.Sprintf("%vpack isn't installed, or isn't a release snakeplant knows. Installing %v.", LINE_PADDING, pack.version))
+			}
+			var cachedTarball string
+			if *Flags.Setup.ArtifactCache != "" {
+				cachedTarball = uploadCachedPack(client, artifactCache{dir: *Flags.Setup.ArtifactCache}, pack, target.arch)
+			}
+			installPack(client, pack, cachedTarball)
+		},
+	}
+}
+
+func packBuilderSteps(client *simplessh.Client, builder string, trusted []string) []Step {
+	packConfig := func(args string) string {
+		out, err := client.Exec(fmt.Sprintf("%v config %v", packPath, args))
+		AssertNoErr(err, fmt.Sprintf("'pack config %v' failed: %v", args, strings.TrimSpace(string(out))))
+		return string(out)
+	}
+
+	// Checks can run before pack is installed, like with '--plan', so they can't quit when pack isn't there.
+	packInstalled := func() bool {
+		_, err := client.Exec(fmt.Sprintf("[ -x %v ]", packPath))
+		AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check if 'pack' already exists.")
+		return err == nil
+	}
+
+	untrusted := func() []string {
+		listed := strings.Fields(packConfig("trusted-builders list"))
+		var missing []string
+		for _, name := range trusted {
+			if !containsString(listed, name) {
+				missing = append(missing, name)
+			}
+		}
+		return missing
+	}
+
+	return []Step{
+		{
+			Name:        "set-pack-builder",
+			Description: "Setting pack's default builder",
+			DependsOn:   []string{"install-pack"},
+			Inputs:      []string{builder},
+			Check: func() bool {
+				return !packInstalled() || !strings.Contains(packConfig("default-builder"), builder)
+			},
+			Apply: func() {
+				PrintSubStepInformation(fmt.Sprintf("%v%v", LINE_PADDING, strings.TrimSpace(packConfig("default-builder"))))
+				packConfig(fmt.Sprintf("default-builder %v", builder))
+			},
+		},
+		{
+			Name:        "trust-pack-builders",
+			Description: "Trusting pack builders",
+			DependsOn:   []string{"install-pack"},
+			Inputs:      trusted,
+			Check: func() bool {
+				return !packInstalled() || len(untrusted()) > 0
+			},
+			Apply: func() {
+				// A trusted builder runs every buildpack phase in one container, with access to the registry credentials, so
+				// only builders you'd trust with those should be here.
+				for _, name := range untrusted() {
+					PrintSubStepInformation(fmt.Sprintf("%vTrusting %v.", LINE_PADDING, name))
+					packConfig(fmt.Sprintf("trusted-builders add %v", name))
+				}
+			},
+		},
+	}
+}
+
+var packCmd = &cobra.Command{
+	Use:   "pack",
+	Short: "Manages the version of pack on your server.",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+		os.Exit(0)
+	},
+}
+
+var packUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Installs a different version of pack, and keeps the current one for 'rollback'.",
+	Long: `'upgrade' downloads the pack release given by '--version', checks it against the checksums snakeplant has for
+it, and swaps it in. The version it replaced is kept, and 'snakeplant pack rollback' puts it back.`,
+	Args: cobra.NoArgs,
+	Run:  packUpgrade,
+}
+
+var packRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Puts back the version of pack that was installed before the last 'upgrade'.",
+	Args:  cobra.NoArgs,
+	Run:   packRollback,
+}
+
+func init() {
+	RootCmd.AddCommand(packCmd)
+	packCmd.AddCommand(packUpgradeCmd)
+	packCmd.AddCommand(packRollbackCmd)
+	Flags.Pack.Port = packCmd.PersistentFlags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	Flags.Pack.Host = packCmd.PersistentFlags().StringP("host", "", "", "The host name or IP address of your server.")
+	Flags.Pack.Key = packCmd.PersistentFlags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	Flags.Pack.Version = packUpgradeCmd.Flags().StringP("version", "", "", fmt.Sprintf("The version of pack to install. One of: %v.", strings.Join(packVersions(), ", ")))
+	Flags.Pack.ArtifactCache = packUpgradeCmd.Flags().StringP("artifact-cache", "", "", "Install pack from this cache instead of downloading it on the server. See 'snakeplant cache'.")
+	packCmd.MarkPersistentFlagRequired("host")
+	packUpgradeCmd.MarkFlagRequired("version")
+}
+
+func dialPack() *simplessh.Client {
+	client, err := simplessh.ConnectWithKeyFileTimeout(fmt.Sprintf("%v:%v", *Flags.Pack.Host, *Flags.Pack.Port), "root", *Flags.Pack.Key, 5*time.Second)
+	AssertNoErr(err, "Unable to establish a connection.")
+	return client
+}
+
+func describeInstalledPack(client *simplessh.Client, binaryPath string) string {
+	out, err := client.Exec(fmt.Sprintf("%v version", binaryPath))
+	if err != nil {
+		return "an unknown version"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func packUpgrade(cmd *cobra.Command, args []string) {
+	client := dialPack()
+	defer client.Close()
+
+	arch := detectArchitecture(client)
+	pack := findPackArtifact(*Flags.Pack.Version, arch)
+	if installed, ok := installedPackVersion(client, arch); ok && installed == pack.version {
+		PrintSubStepInformation(fmt.Sprintf("pack %v is already installed.", pack.version))
+		return
+	}
+
+	var cachedTarball string
+	if *Flags.Pack.ArtifactCache != "" {
+		cachedTarball = uploadCachedPack(client, artifactCache{dir: *Flags.Pack.ArtifactCache}, pack, arch)
+	}
+
+	previous := describeInstalledPack(client, packPath)
+	installPack(client, pack, cachedTarball)
+	PrintSubStepInformation(fmt.Sprintf("Upgraded pack from %v to %v. 'snakeplant pack rollback' puts %v back.", previous, describeInstalledPack(client, packPath), previous))
+}
+
+func packRollback(cmd *cobra.Command, args []string) {
+	client := dialPack()
+	defer client.Close()
+
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", previousPackPath))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check for a previous version of pack.")
+	if err != nil {
+		PrintMessageAndQuit(fmt.Sprintf("There's no previous version of pack at %v to roll back to.", previousPackPath))
+	}
+
+	current := describeInstalledPack(client, packPath)
+	previous := describeInstalledPack(client, previousPackPath)
+
+	// Swapped, so running rollback again undoes the rollback. The recorded hashes go with them.
+	SSHCommand(client, fmt.Sprintf("cp -p %v %v.swap && cp -p %v %v.new && mv -f %v.new %v && mv -f %v.swap %v",
+		packPath, packPath, previousPackPath, packPath, packPath, packPath, packPath, previousPackPath))
+	SSHCommand(client, fmt.Sprintf("touch %v %v && mv -f %v %v.swap && mv -f %v %v && mv -f %v.swap %v",
+		packShaPath(packPath), packShaPath(previousPackPath), packShaPath(packPath), packShaPath(packPath),
+		packShaPath(previousPackPath), packShaPath(packPath), packShaPath(packPath), packShaPath(previousPackPath)))
+	PrintSubStepInformation(fmt.Sprintf("Rolled pack back from %v to %v.", current, previous))
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+)
+
+// What /etc/os-release says about the server. See https://www.freedesktop.org/software/systemd/man/os-release.html
+type OSRelease struct {
+	ID         string
+	VersionID  string
+	Codename   string
+	PrettyName string
+}
+
+func (o OSRelease) String() string {
+	if o.PrettyName != "" {
+		return o.PrettyName
+	}
+	return fmt.Sprintf("%v %v", o.ID, o.VersionID)
+}
+
+func parseOSRelease(content string) OSRelease {
+	values := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		// Values are allowed to be quoted with either kind of quote, but don't have to be.
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+
+	codename := values["VERSION_CODENAME"]
+	if codename == "" {
+		codename = values["UBUNTU_CODENAME"]
+	}
+
+	return OSRelease{
+		ID:         values["ID"],
+		VersionID:  values["VERSION_ID"],
+		Codename:   codename,
+		PrettyName: values["PRETTY_NAME"],
+	}
+}
+
+func detectOS(client *simplessh.Client) OSRelease {
+	out, err := client.Exec("cat /etc/os-release")
+	AssertNoErr(err, "Could not read /etc/os-release.")
+	return parseOSRelease(string(out))
+}
+
+type aptSourcesFile struct {
+	path string
+	// Newer releases use the multi-line "deb822" format instead of one 'deb ...' line per source.
+	// See https://manpages.ubuntu.com/manpages/noble/man5/sources.list.5.html
+	deb822 bool
+}
+
+// Everything that changes depending on which OS the server is running.
+type platform struct {
+	id        string
+	versionID string
+	// Filled in after the platform is found, since every supported OS is supported on every supported architecture.
+	arch string
+	// Filled in from /etc/os-release, like 'jammy'. Third party apt repositories are split up by it.
+	codename string
+	// Where the OS's apt sources can be, in the order they're looked for.
+	aptSourcesFiles []aptSourcesFile
+	// Filled in with whichever of aptSourcesFiles the server has.
+	aptSources aptSourcesFile
+	// What the OS uses out of the box. Used when '--firewall-backend' is 'auto'.
+	firewallBackend string
+	// Only needs an entry when the package is called something different than it is on Ubuntu 22.04.
+	packageNames map[string]string
+}
+
+func (p platform) String() string {
+	return fmt.Sprintf("%v %v (%v)", p.id, p.versionID, p.arch)
+}
+
+var supportedPlatforms = []platform{
+	{
+		id:              "ubuntu",
+		versionID:       "22.04",
+		aptSourcesFiles: []aptSourcesFile{{path: "/etc/apt/sources.list"}},
+		firewallBackend: "iptables",
+	},
+	{
+		id:              "ubuntu",
+		versionID:       "24.04",
+		aptSourcesFiles: []aptSourcesFile{{path: "/etc/apt/sources.list.d/ubuntu.sources", deb822: true}},
+		firewallBackend: "nftables",
+	},
+	{
+		id:        "debian",
+		versionID: "12",
+		aptSourcesFiles: []aptSourcesFile{
+			{path: "/etc/apt/sources.list.d/debian.sources", deb822: true},
+			{path: "/etc/apt/sources.list"},
+		},
+		firewallBackend: "nftables",
+	},
+}
+
+func findPlatform(release OSRelease) (platform, bool) {
+	for _, p := range supportedPlatforms {
+		if p.id == release.ID && p.versionID == release.VersionID {
+			return p, true
+		}
+	}
+	return platform{}, false
+}
+
+func supportedPlatformNames() string {
+	names := make([]string, len(supportedPlatforms))
+	for i, p := range supportedPlatforms {
+		names[i] = fmt.Sprintf("%v %v", p.id, p.versionID)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (p platform) packageName(name string) string {
+	if renamed, ok := p.packageNames[name]; ok {
+		return renamed
+	}
+	return name
+}
+
+// Architectures are named the way dpkg names them, since that's also how apt repositories name them.
+var supportedArchitectures = []string{"amd64", "arm64"}
+
+func detectArchitecture(client *simplessh.Client) string {
+	out, err := client.Exec("dpkg --print-architecture")
+	AssertNoErr(err, "Could not get architecture.")
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	// The server's timezone has to be looked up here, and not every machine running snakeplant has tzdata installed.
+	_ "time/tzdata"
+)
+
+const (
+	rebootServicePath = "/etc/systemd/system/snakeplant-reboot.service"
+	rebootTimerPath   = "/etc/systemd/system/snakeplant-reboot.timer"
+	rebootTimerUnit   = "snakeplant-reboot.timer"
+	// Set in the service, and read back by 'reboot-window show'.
+	rebootWithUsersVariable = "SNAKEPLANT_REBOOT_WITH_USERS"
+)
+
+// In the order time.Weekday numbers them, and named the way systemd calendar events name them.
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// When the server is allowed to reboot to finish installing security updates. The time is in the server's timezone,
+// since that's what systemd uses.
+type rebootWindow struct {
+	hour   int
+	minute int
+	// Empty means every day.
+	days      []time.Weekday
+	withUsers bool
+}
+
+// Takes things like '2:00' or '23:30'.
+func parseRebootTime(value string) (int, int) {
+	hourStr, minuteStr, ok := strings.Cut(strings.TrimSpace(value), ":")
+	hour, hourErr := strconv.Atoi(hourStr)
+	minute, minuteErr := strconv.Atoi(minuteStr)
+	if !ok || hourErr != nil || minuteErr != nil || len(minuteStr) != 2 || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not a time. It has to be HH:MM on a 24 hour clock, like '2:00' or '23:30'.", value))
+	}
+	return hour, minute
+}
+
+// Takes 'mon', 'Monday', 'MON' and so on.
+func lookupWeekday(value string) (time.Weekday, bool) {
+	for i := range weekdayNames {
+		if len(value) >= 3 && strings.HasPrefix(strings.ToLower(time.Weekday(i).String()), strings.ToLower(value)) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+func parseWeekday(value string) time.Weekday {
+	day, ok := lookupWeekday(value)
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not a day of the week. Use names like 'mon' or 'saturday'.", value))
+	}
+	return day
+}
+
+func newRebootWindow(rebootTime string, days []string, withUsers bool) rebootWindow {
+	hour, minute := parseRebootTime(rebootTime)
+	window := rebootWindow{hour: hour, minute: minute, withUsers: withUsers}
+
+	// Kept in weekday order, so the same days given in a different order make the same timer.
+	allowed := map[time.Weekday]bool{}
+	for _, day := range days {
+		allowed[parseWeekday(day)] = true
+	}
+	for i := range weekdayNames {
+		if allowed[time.Weekday(i)] {
+			window.days = append(window.days, time.Weekday(i))
+		}
+	}
+	if len(window.days) == len(weekdayNames) {
+		window.days = nil
+	}
+	return window
+}
+
+func (w rebootWindow) clock() string {
+	return fmt.Sprintf("%02d:%02d", w.hour, w.minute)
+}
+
+func (w rebootWindow) dayNames() string {
+	if len(w.days) == 0 {
+		return "every day"
+	}
+	names := make([]string, len(w.days))
+	for i, day := range w.days {
+		names[i] = weekdayNames[day]
+	}
+	return strings.Join(names, ",")
+}
+
+func (w rebootWindow) allows(day time.Weekday) bool {
+	if len(w.days) == 0 {
+		return true
+	}
+	for _, allowed := range w.days {
+		if allowed == day {
+			return true
+		}
+	}
+	return false
+}
+
+// See 'man systemd.time'. Without a timezone at the end, it's the server's.
+func (w rebootWindow) onCalendar() string {
+	if len(w.days) == 0 {
+		return fmt.Sprintf("*-*-* %v:00", w.clock())
+	}
+	return fmt.Sprintf("%v *-*-* %v:00", w.dayNames(), w.clock())
+}
+
+// Reads back what onCalendar wrote. ok is false for anything else, since the timer could have been edited by hand.
+func parseOnCalendar(value string) (rebootWindow, bool) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 && len(fields) != 3 {
+		return rebootWindow{}, false
+	}
+
+	clock := strings.TrimSuffix(fields[len(fields)-1], ":00")
+	hourStr, minuteStr, ok := strings.Cut(clock, ":")
+	hour, hourErr := strconv.Atoi(hourStr)
+	minute, minuteErr := strconv.Atoi(minuteStr)
+	if !ok || hourErr != nil || minuteErr != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return rebootWindow{}, false
+	}
+
+	window := rebootWindow{hour: hour, minute: minute}
+	if len(fields) == 3 {
+		for _, name := range strings.Split(fields[0], ",") {
+			day, ok := lookupWeekday(name)
+			if !ok {
+				return rebootWindow{}, false
+			}
+			window.days = append(window.days, day)
+		}
+	}
+	return window, true
+}
+
+// The next time the server could reboot, in loc, which should be the server's timezone.
+func (w rebootWindow) next(now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	for days := 0; days <= 7; days++ {
+		candidate := time.Date(now.Year(), now.Month(), now.Day()+days, w.hour, w.minute, 0, 0, loc)
+		if candidate.After(now) && w.allows(candidate.Weekday()) {
+			return candidate
+		}
+	}
+	// Every week has at least one allowed day, so this can't happen.
+	panic("no reboot in the next week")
+}
+
+// Whether to reboot with someone logged in is an environment variable, instead of being baked into the command, so the
+// setting can be read back from the file without guessing.
+func (w rebootWindow) serviceUnit() string {
+	// '$$' is how a unit file says '$'.
+	return fmt.Sprintf(`# Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs.
+[Unit]
+Description=Reboot to finish installing security updates, if any of them need it
+
+[Service]
+Type=oneshot
+Environment=%v=%v
+ExecStart=/bin/sh -c 'test -f /var/run/reboot-required && { test "$$%v" = true || test -z "$$(who)"; } && systemctl reboot || true'
+`, rebootWithUsersVariable, w.withUsers, rebootWithUsersVariable)
+}
+
+// Reads back what serviceUnit wrote. ok is false if the setting isn't there.
+func parseRebootWithUsers(service string) (bool, bool) {
+	prefix := fmt.Sprintf("Environment=%v=", rebootWithUsersVariable)
+	for _, line := range strings.Split(service, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			withUsers, err := strconv.ParseBool(strings.TrimPrefix(line, prefix))
+			return withUsers, err == nil
+		}
+	}
+	return false, false
+}
+
+// There's no 'Persistent=true', so a window that's missed while the server is off is skipped instead of rebooting
+// the server as soon as it comes back up.
+func (w rebootWindow) timerUnit() string {
+	return fmt.Sprintf(`# Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs.
+[Unit]
+Description=Reboot window for security updates
+
+[Timer]
+OnCalendar=%v
+
+[Install]
+WantedBy=timers.target
+`, w.onCalendar())
+}
+
+func detectTimezone(client *simplessh.Client) *time.Location {
+	out, err := client.Exec("timedatectl show -p Timezone --value 2>/dev/null || cat /etc/timezone")
+	AssertNoErr(err, "Could not get the server's timezone.")
+
+	name := strings.TrimSpace(string(out))
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		color.Yellow("%vThe server's timezone is '%v', which snakeplant doesn't know about. Showing times in UTC instead.", LINE_PADDING, name)
+		return time.UTC
+	}
+	return loc
+}
+
+func (w rebootWindow) describe(serverLoc *time.Location) {
+	next := w.next(time.Now(), serverLoc)
+	local := next.In(time.Local)
+
+	PrintSubStepInformation(fmt.Sprintf("%vThe server can reboot for security updates at %v %v (%v), %v.", LINE_PADDING, w.clock(), serverLoc, next.Format("MST"), w.dayNames()))
+	PrintSubStepInformation(fmt.Sprintf("%vThe next window is %v server time, which is %v your time (%v).", LINE_PADDING, next.Format("Mon Jan 2 15:04"), local.Format("Mon Jan 2 15:04"), local.Format("MST")))
+	if !w.withUsers {
+		PrintSubStepInformation(fmt.Sprintf("%vIf someone is logged in, the reboot waits for the next window.", LINE_PADDING))
+	}
+}
+
+func rebootWindowSteps(client *simplessh.Client, window rebootWindow) []Step {
+	return []Step{
+		managedFileStep(client, "write-reboot-service", "Writing the reboot service", managedFile{
+			path:  rebootServicePath,
+			owner: "root:root",
+			mode:  0644,
+			render: func(string) string {
+				return window.serviceUnit()
+			},
+		}, window.serviceUnit()),
+		managedFileStep(client, "write-reboot-timer", "Writing the reboot timer", managedFile{
+			path:  rebootTimerPath,
+			owner: "root:root",
+			mode:  0644,
+			render: func(string) string {
+				return window.timerUnit()
+			},
+		}, window.timerUnit()),
+		{
+			Name:        "enable-reboot-timer",
+			Description: "Scheduling the reboot window",
+			DependsOn:   []string{"write-reboot-service", "write-reboot-timer"},
+			Inputs:      []string{window.onCalendar(), strconv.FormatBool(window.withUsers)},
+			Check: func() bool {
+				out, err := client.Exec(fmt.Sprintf("systemctl is-enabled %v && systemctl is-active %v && systemctl show -p NeedDaemonReload --value %v", rebootTimerUnit, rebootTimerUnit, rebootTimerUnit))
+				AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check the reboot timer.")
+				return err != nil || strings.HasSuffix(strings.TrimSpace(string(out)), "yes")
+			},
+			Apply: func() {
+				SSHCommand(client, "systemctl daemon-reload")
+				SSHCommand(client, fmt.Sprintf("systemctl enable %v", rebootTimerUnit))
+				SSHCommand(client, fmt.Sprintf("systemctl restart %v", rebootTimerUnit))
+			},
+		},
+	}
+}
+
+var rebootWindowCmd = &cobra.Command{
+	Use:   "reboot-window",
+	Short: "Shows when your server reboots to finish installing security updates.",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+		os.Exit(0)
+	},
+}
+
+var rebootWindowShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Shows the reboot window in the server's timezone and in yours.",
+	Long: `'show' reads the reboot window that 'setup' scheduled from the server, and shows when the next one is in the
+server's timezone and in yours. It also shows if there are updates waiting on a reboot right now.`,
+	Args: cobra.NoArgs,
+	Run:  rebootWindowShow,
+}
+
+func init() {
+	RootCmd.AddCommand(rebootWindowCmd)
+	rebootWindowCmd.AddCommand(rebootWindowShowCmd)
+	Flags.RebootWindow.Port = rebootWindowCmd.PersistentFlags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	Flags.RebootWindow.Host = rebootWindowCmd.PersistentFlags().StringP("host", "", "", "The host name or IP address of your server.")
+	Flags.RebootWindow.Key = rebootWindowCmd.PersistentFlags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	rebootWindowCmd.MarkPersistentFlagRequired("host")
+}
+
+func rebootWindowShow(cmd *cobra.Command, args []string) {
+	client, err := simplessh.ConnectWithKeyFileTimeout(fmt.Sprintf("%v:%v", *Flags.RebootWindow.Host, *Flags.RebootWindow.Port), "root", *Flags.RebootWindow.Key, 5*time.Second)
+	AssertNoErr(err, "Unable to establish a connection.")
+	defer client.Close()
+
+	content, ok := readRemoteFile(client, rebootTimerPath)
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("There's no reboot window at %v. Run 'snakeplant setup' first.", rebootTimerPath))
+	}
+
+	var window rebootWindow
+	found := false
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "OnCalendar=") {
+			window, found = parseOnCalendar(strings.TrimPrefix(line, "OnCalendar="))
+		}
+	}
+	if !found {
+		PrintMessageAndQuit(fmt.Sprintf("%v doesn't have an 'OnCalendar=' that snakeplant understands. Run 'snakeplant setup' again to fix it.", rebootTimerPath))
+	}
+
+	service, ok := readRemoteFile(client, rebootServicePath)
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("There's no reboot service at %v, so the timer has nothing to run. Run 'snakeplant setup' again to fix it.", rebootServicePath))
+	}
+	window.withUsers, ok = parseRebootWithUsers(service)
+	if !ok {
+		PrintMessageAndQuit(fmt.Sprintf("%v doesn't say whether to reboot with someone logged in. Run 'snakeplant setup' again to fix it.", rebootServicePath))
+	}
+	window.describe(detectTimezone(client))
+
+	_, err = client.Exec(fmt.Sprintf("systemctl is-active %v", rebootTimerUnit))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check the reboot timer.")
+	if err != nil {
+		color.Yellow("%v%v isn't running, so the server won't reboot on its own. Run 'snakeplant setup' again to fix it.", LINE_PADDING, rebootTimerUnit)
+	}
+
+	_, err = client.Exec("[ -f /var/run/reboot-required ]")
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check if a reboot is needed.")
+	if err == nil {
+		out, _ := client.Exec("cat /var/run/reboot-required.pkgs 2>/dev/null")
+		PrintSubStepInformation(fmt.Sprintf("%vUpdates are waiting for the next window: %v", LINE_PADDING, strings.Join(strings.Fields(string(out)), ", ")))
+	} else {
+		PrintSubStepInformation(fmt.Sprintf("%vNo updates are waiting on a reboot.", LINE_PADDING))
+	}
+}
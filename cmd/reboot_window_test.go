@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRebootTime(t *testing.T) {
+	tests := []struct {
+		value  string
+		hour   int
+		minute int
+	}{
+		{value: "2:00", hour: 2, minute: 0},
+		{value: "02:00", hour: 2, minute: 0},
+		{value: "23:30", hour: 23, minute: 30},
+		{value: "0:05", hour: 0, minute: 5},
+		{value: " 4:15 ", hour: 4, minute: 15},
+	}
+
+	for _, test := range tests {
+		if hour, minute := parseRebootTime(test.value); hour != test.hour || minute != test.minute {
+			t.Errorf("parseRebootTime(%q) = %v, %v, want %v, %v", test.value, hour, minute, test.hour, test.minute)
+		}
+	}
+}
+
+func TestOnCalendar(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     rebootWindow
+		onCalendar string
+	}{
+		{
+			name:       "every day",
+			window:     newRebootWindow("2:00", nil, false),
+			onCalendar: "*-*-* 02:00:00",
+		},
+		{
+			name:       "some days, given out of order",
+			window:     newRebootWindow("23:30", []string{"saturday", "MON", "wed"}, false),
+			onCalendar: "Mon,Wed,Sat *-*-* 23:30:00",
+		},
+		{
+			name:       "every day given one by one",
+			window:     newRebootWindow("4:05", []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}, false),
+			onCalendar: "*-*-* 04:05:00",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.window.onCalendar(); got != test.onCalendar {
+				t.Fatalf("onCalendar() = %q, want %q", got, test.onCalendar)
+			}
+			parsed, ok := parseOnCalendar(test.onCalendar)
+			if !ok || !reflect.DeepEqual(parsed, test.window) {
+				t.Errorf("parseOnCalendar(%q) = %+v, %v, want %+v, true", test.onCalendar, parsed, ok, test.window)
+			}
+		})
+	}
+}
+
+func TestParseOnCalendarEditedByHand(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"daily",
+		"Funday *-*-* 02:00:00",
+		"Mon,xyz *-*-* 02:00:00",
+		"*-*-* 25:00:00",
+		"*-*-* 02:00",
+		"Mon *-*-* 02:00:00 UTC",
+	} {
+		if window, ok := parseOnCalendar(value); ok {
+			t.Errorf("parseOnCalendar(%q) = %+v, true, want false", value, window)
+		}
+	}
+}
+
+func TestRebootWindowNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-10-21 is a Wednesday.
+	tests := []struct {
+		name   string
+		window rebootWindow
+		now    time.Time
+		loc    *time.Location
+		want   time.Time
+	}{
+		{
+			name:   "later today",
+			window: newRebootWindow("23:30", nil, false),
+			now:    time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			want:   time.Date(2026, 10, 21, 23, 30, 0, 0, time.UTC),
+		},
+		{
+			name:   "already past today",
+			window: newRebootWindow("2:00", nil, false),
+			now:    time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			want:   time.Date(2026, 10, 22, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "right at the window waits a day",
+			window: newRebootWindow("2:00", nil, false),
+			now:    time.Date(2026, 10, 21, 2, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			want:   time.Date(2026, 10, 22, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "skips days that aren't allowed",
+			window: newRebootWindow("2:00", []string{"sat", "sun"}, false),
+			now:    time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			want:   time.Date(2026, 10, 24, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "only day is today, but already past",
+			window: newRebootWindow("2:00", []string{"wed"}, false),
+			now:    time.Date(2026, 10, 21, 10, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			want:   time.Date(2026, 10, 28, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "in the server's timezone",
+			window: newRebootWindow("2:00", []string{"wed"}, false),
+			// 01:30 on Wednesday in New York.
+			now:  time.Date(2026, 10, 21, 5, 30, 0, 0, time.UTC),
+			loc:  newYork,
+			want: time.Date(2026, 10, 21, 2, 0, 0, 0, newYork),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.window.next(test.now, test.loc); !got.Equal(test.want) || got.Location() != test.loc {
+				t.Errorf("next(%v) = %v, want %v", test.now, got, test.want)
+			}
+		})
+	}
+}
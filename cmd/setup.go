@@ -1,11 +1,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/sfreiberg/simplessh"
 	"github.com/spf13/cobra"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 )
@@ -13,8 +15,10 @@ import (
 var setupCmd = &cobra.Command{
 	Use:   "setup",
 	Short: "Sets up your server to be ready for use.",
-	Long:  `'setup' is designed to be idempotent. This means that it's always safe to run it again, even if it errors out.'`,
-	Run:   setup,
+	Long: `'setup' is designed to be idempotent. This means that it's always safe to run it again, even if it errors out.'
+Every step that finishes is recorded on the server, so running it again skips the steps that are done, unless
+something they depend on (like a flag) has changed.`,
+	Run: setup,
 }
 
 func init() {
@@ -22,15 +26,103 @@ func init() {
 	Flags.Setup.Port = setupCmd.Flags().IntP("port", "", 22, "The Port number of the ssh daemon running on your server.")
 	Flags.Setup.Host = setupCmd.Flags().StringP("host", "", "", "The Host name or IP address of your server.")
 	Flags.Setup.Key = setupCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
-	Flags.Setup.RebootTime = setupCmd.Flags().StringP("rebootTime", "", "", "The time that your server will be configured to reboot to apply security patches. An example is '2:00'.")
+	Flags.Setup.RebootTime = setupCmd.Flags().StringP("rebootTime", "", "", "The time that your server will be configured to reboot to apply security patches, as HH:MM in the server's timezone. An example is '2:00'.")
+	Flags.Setup.RebootDays = setupCmd.Flags().StringSliceP("reboot-days", "", []string{}, "Only reboot on these days of the week, like 'sat,sun'. Defaults to every day.")
+	Flags.Setup.RebootWithUsers = setupCmd.Flags().BoolP("reboot-with-users", "", true, "Reboot to apply security patches even if someone is logged in.")
+	Flags.Setup.UpgradeBlocklist = setupCmd.Flags().StringSliceP("upgrade-blocklist", "", []string{"docker", "containerd"}, "Packages that are never upgraded automatically, since upgrading them restarts your apps. Each one matches every package whose name starts with it.")
+	Flags.Setup.UpgradeOrigins = setupCmd.Flags().StringSliceP("upgrade-origins", "", []string{}, "Where automatic upgrades come from, as unattended-upgrades 'Origins-Pattern' entries like 'origin=Ubuntu,archive=${distro_codename}-security'. Defaults to your OS's own security updates.")
+	Flags.Setup.RemoveUnusedDependencies = setupCmd.Flags().BoolP("remove-unused-dependencies", "", true, "Remove packages and old kernels that nothing needs anymore after an automatic upgrade.")
+	Flags.Setup.UpgradeMail = setupCmd.Flags().StringP("upgrade-mail", "", "", "Send a report of automatic upgrades to this address. The server needs to be able to send mail.")
+	Flags.Setup.UpgradeMailReport = setupCmd.Flags().StringP("upgrade-mail-report", "", "on-change", fmt.Sprintf("When to send the report to '--upgrade-mail'. One of: %v.", strings.Join(mailReportValues, ", ")))
+	Flags.Setup.UpgradeSyslog = setupCmd.Flags().BoolP("upgrade-syslog", "", true, "Log automatic upgrades to syslog.")
+	Flags.Setup.Timezone = setupCmd.Flags().StringP("timezone", "", "", "The timezone to set on your server, like 'UTC' or 'America/New_York'. Defaults to leaving it as it is. '--rebootTime' is in this timezone.")
+	Flags.Setup.NTP = setupCmd.Flags().StringP("ntp", "", "timesyncd", "What keeps your server's clock right. Either 'timesyncd' or 'chrony'.")
+	Flags.Setup.Hostname = setupCmd.Flags().StringP("hostname", "", "", "The hostname to give your server, like 'web1' or 'web1.example.com'. It's also added to /etc/hosts. Defaults to leaving it as it is.")
+	Flags.Setup.SwapSize = setupCmd.Flags().StringP("swap-size", "", "1G", fmt.Sprintf("How big to make /swapfile, like '512M' or '2G'. '0' doesn't create one, and anything else has to be at least %vM. Builds on servers with 1GB of memory or less get killed for running out of memory without it.", minSwapSize>>20))
+	Flags.Setup.Swappiness = setupCmd.Flags().IntP("swappiness", "", 10, "How willing the kernel is to swap, from 0 to 200. Low values only swap when memory is running out.")
+	Flags.Setup.DockerEngine = setupCmd.Flags().StringP("docker-engine", "", "docker-ce", "Which docker engine to install. 'docker-ce' comes from Docker's own apt repository. 'docker.io' is the one your OS builds.")
+	Flags.Setup.DockerVersion = setupCmd.Flags().StringP("docker-version", "", "", "The docker version to install and hold, like '27.3.1'. Defaults to the newest version the first time, and keeping whatever is installed after that.")
+	Flags.Setup.DockerLogMaxSize = setupCmd.Flags().StringP("docker-log-max-size", "", "10m", "How big a container's log file can get before it's rotated.")
+	Flags.Setup.DockerLogMaxFiles = setupCmd.Flags().IntP("docker-log-max-files", "", 3, "How many rotated log files are kept for each container.")
+	Flags.Setup.PackVersion = setupCmd.Flags().StringP("pack-version", "", "", fmt.Sprintf("The version of pack to install. One of: %v. Defaults to %v, or keeping the version 'snakeplant pack upgrade' installed.", strings.Join(packVersions(), ", "), defaultPackVersion))
+	Flags.Setup.PackBuilder = setupCmd.Flags().StringP("pack-builder", "", "heroku/builder:22", "The builder 'pack build' uses when it isn't given one.")
+	Flags.Setup.PackTrustedBuilders = setupCmd.Flags().StringSliceP("pack-trusted-builders", "", []string{"heroku/builder:22"}, "Builders that pack trusts to run every build step in one container. Can be given more than once.")
+	Flags.Setup.TCPPorts = setupCmd.Flags().StringP("tcp-ports", "", "", "A comma separated list of TCP ports to open other than ssh, 80, 443 and 444. A port can be restricted to a source with '@', like '5432@10.0.0.0/8'.")
+	Flags.Setup.UDPPorts = setupCmd.Flags().StringP("udp-ports", "", "", "A comma separated list of UDP ports to open. Works the same way as '--tcp-ports'.")
+	Flags.Setup.SSHFrom = setupCmd.Flags().StringSliceP("ssh-from", "", []string{}, "Only allow ssh from this IP address or CIDR, like your office's. Can be given more than once. Defaults to anywhere. If only IPv4 sources are given, ssh is closed over IPv6.")
+	Flags.Setup.FirewallRollbackSeconds = setupCmd.Flags().IntP("firewall-rollback-seconds", "", 60, "If a new ssh connection can't be made this many seconds after loading the firewall rules, they are rolled back so you aren't locked out.")
+	Flags.Setup.FirewallBackend = setupCmd.Flags().StringP("firewall-backend", "", "auto", "Either 'iptables' or 'nftables'. 'auto' picks whatever your server's OS uses by default.")
+	Flags.Setup.AllowSSHPasswords = setupCmd.Flags().BoolP("allow-ssh-passwords", "", false, "Don't turn off logging in to ssh with a password, and undo it if setup turned it off before. By default only keys can be used.")
+	Flags.Setup.SSHProtection = setupCmd.Flags().StringP("ssh-protection", "", "none", fmt.Sprintf("How ssh is protected from brute force logins. 'fail2ban' bans addresses with too many failed logins. 'rate-limit' has the firewall drop addresses that connect too often. One of: %v.", strings.Join(sshProtectionModes, ", ")))
+	Flags.Setup.SSHBanTime = setupCmd.Flags().StringP("ssh-ban-time", "", "1h", "How long fail2ban bans an address for, like '10m' or '1h'.")
+	Flags.Setup.SSHFindTime = setupCmd.Flags().StringP("ssh-find-time", "", "10m", "How far back fail2ban counts failed logins.")
+	Flags.Setup.SSHMaxRetries = setupCmd.Flags().IntP("ssh-max-retries", "", 5, "How many failed logins within '--ssh-find-time' get an address banned by fail2ban.")
+	Flags.Setup.SSHRateLimit = setupCmd.Flags().IntP("ssh-rate-limit", "", 6, fmt.Sprintf("How many new ssh connections an address can make in a minute with '--ssh-protection rate-limit', up to %v. snakeplant's own connections count too.", maxSSHRateLimit))
+	Flags.Setup.DisableSuites = setupCmd.Flags().StringSliceP("disable-suites", "", []string{"backports"}, "Suites to turn off in your OS's apt sources, like 'backports' or 'proposed'. Can be given more than once.")
+	Flags.Setup.EnableSuites = setupCmd.Flags().StringSliceP("enable-suites", "", []string{}, "Suites to turn on in your OS's apt sources. These win over '--disable-suites'. Can be given more than once.")
+	Flags.Setup.DisableComponents = setupCmd.Flags().StringSliceP("disable-components", "", []string{}, "Components to take out of your OS's apt sources, like 'multiverse'. Can be given more than once.")
+	Flags.Setup.EnableComponents = setupCmd.Flags().StringSliceP("enable-components", "", []string{}, "Components to add to your OS's apt sources, like 'universe' or 'contrib'. Can be given more than once.")
+	Flags.Setup.AptMirror = setupCmd.Flags().StringP("apt-mirror", "", "", "A mirror to get your OS's packages from, like 'http://mirror.example.com/ubuntu'. Security updates still come from your OS. Defaults to leaving the sources as they are.")
+	Flags.Setup.AptProxy = setupCmd.Flags().StringP("apt-proxy", "", "", "An HTTP proxy for apt to download through, like 'http://proxy.example.com:3128'. Defaults to no proxy.")
+	Flags.Setup.Packages = setupCmd.Flags().StringSliceP("packages", "", []string{}, "Other packages to install along with the ones setup needs. A version can be pinned with '=', like 'jq=1.6-2.1', which also works for the ones setup needs. Can be given more than once.")
+	Flags.Setup.ArtifactCache = setupCmd.Flags().StringP("artifact-cache", "", "", "Install everything from this cache instead of the internet, for servers that can't reach it. See 'snakeplant cache'.")
+	Flags.Setup.DpkgLockTimeout = setupCmd.Flags().IntP("dpkg-lock-timeout", "", 600, "How many seconds to wait for something else using apt, like unattended-upgrades right after boot, to finish.")
+	Flags.Setup.Plan = setupCmd.Flags().BoolP("plan", "", false, "Only check what each step would do, and print it. Nothing on your server is changed.")
+	Flags.Setup.Only = setupCmd.Flags().StringSliceP("only", "", []string{}, "Only run these steps, by name. '--plan' lists the names. Can be given more than once.")
+	Flags.Setup.Skip = setupCmd.Flags().StringSliceP("skip", "", []string{}, "Don't run these steps, by name. Can be given more than once.")
+	Flags.Setup.Force = setupCmd.Flags().BoolP("force", "", false, fmt.Sprintf("Run every step again, even the ones that %v says were already done.", setupStatePath))
 	setupCmd.MarkFlagRequired("host")
 	setupCmd.MarkFlagRequired("rebootTime")
 }
 
 func setup(cmd *cobra.Command, args []string) {
-	panic("need to look into the docker.io thing and use pack config default-builder heroku/builder:22 and check for no ssh password logins allowed")
+	// Parse this before connecting so that a typo doesn't leave the server half set up.
+	policy := newFirewallPolicy(*Flags.Setup.Port, *Flags.Setup.SSHFrom, *Flags.Setup.TCPPorts, *Flags.Setup.UDPPorts)
+	upgrades := newUnattendedUpgradesOptions()
+	window := newRebootWindow(*Flags.Setup.RebootTime, *Flags.Setup.RebootDays, *Flags.Setup.RebootWithUsers)
+	docker := dockerOptions{
+		engine:      findDockerEngine(*Flags.Setup.DockerEngine),
+		version:     *Flags.Setup.DockerVersion,
+		logMaxSize:  *Flags.Setup.DockerLogMaxSize,
+		logMaxFiles: *Flags.Setup.DockerLogMaxFiles,
+		fromCache:   *Flags.Setup.ArtifactCache != "",
+	}
+	protection := newSSHProtectionOptions()
+	if protection.mode == "rate-limit" {
+		policy.SSHRateLimit = protection.rateLimit
+	}
+	sources := newAptSourcesOptions()
+	if *Flags.Setup.AptProxy != "" {
+		parseAptURL(*Flags.Setup.AptProxy, "--apt-proxy")
+	}
+	// Whether there's a build for the server's architecture is checked once it's known.
+	if *Flags.Setup.PackVersion != "" {
+		findPackRelease(*Flags.Setup.PackVersion)
+	}
+	var timezone *time.Location
+	if *Flags.Setup.Timezone != "" {
+		timezone = parseTimezone(*Flags.Setup.Timezone)
+	}
+	if *Flags.Setup.Hostname != "" {
+		parseHostname(*Flags.Setup.Hostname)
+	}
+	parseSwapSize(*Flags.Setup.SwapSize)
+	if *Flags.Setup.Swappiness < 0 || *Flags.Setup.Swappiness > 200 {
+		PrintMessageAndQuit("'--swappiness' has to be between 0 and 200.")
+	}
+	if _, ok := ntpServices[*Flags.Setup.NTP]; !ok {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not an NTP client snakeplant knows about. It has to be 'timesyncd' or 'chrony'.", *Flags.Setup.NTP))
+	}
+	parseAptPackages(*Flags.Setup.Packages)
+	var artifacts map[string]string
+	if *Flags.Setup.ArtifactCache != "" {
+		artifacts = artifactCache{dir: *Flags.Setup.ArtifactCache}.verify()
+	}
+
 	socket := fmt.Sprintf("%v:%v", *Flags.Setup.Host, *Flags.Setup.Port)
 
+	// Connecting and finding out what the server is running aren't steps, since every step's Check needs to know. They
+	// don't change anything, so they run even with '--plan'.
 	counter := 1
 	var client *simplessh.Client
 	var err error
@@ -41,152 +133,192 @@ func setup(cmd *cobra.Command, args []string) {
 	})
 	defer client.Close()
 
+	var target platform
 	step(&counter, "Checking OS version of server", func() {
-		output, err := client.Exec("uname -a")
-		AssertNoErr(err, "Could not get os version.")
+		release := detectOS(client)
+		PrintSubStepInformation(fmt.Sprintf("%vFound %v (id: '%v', version: '%v', codename: '%v').", LINE_PADDING, release, release.ID, release.VersionID, release.Codename))
 
-		if !strings.Contains(string(output), "Linux Ubuntu-2204-jammy-amd64-base") {
-			color.Red("'snakeplant' is only supported for https://cdimage.ubuntu.com/ubuntu-base/releases/22.04/release/.")
+		var ok bool
+		target, ok = findPlatform(release)
+		if !ok {
+			color.Red("'snakeplant' is only supported on %v.", supportedPlatformNames())
 			os.Exit(1)
 		}
+		target.codename = release.Codename
+		target.aptSources = detectAptSources(client, target)
 	})
 	step(&counter, "Checking architecture of server", func() {
-		output, err := client.Exec("uname -p")
-		AssertNoErr(err, "Could not get architecture.")
-
-		if !strings.Contains(string(output), "x86_64") {
-			color.Red("'snakeplant' is only supported on x86_64.")
-			os.Exit(1)
-		}
-	})
-
-	step(&counter, "Disabling backports", func() {
-		sourcesFilePath := "/etc/apt/sources.list"
-		safeIdempotentCopyFile(client, sourcesFilePath, fmt.Sprintf("%v.bak", sourcesFilePath))
-
-		out, err := client.Exec("mktemp")
-		AssertNoErr(err, "Could not create temp file.")
-
-		tempFile := strings.TrimSpace(string(out))
-
-		// We technically don't need to make a copy each time, but it allows us to start fresh every time we run setup,
-		// so if the file got changed and screwed up somehow, setup would fix it.
-		sshCommand(client, fmt.Sprintf("cp %v %v", sourcesFilePath, tempFile))
-
-		sshCommand(client, fmt.Sprintf("sed -i 's|.*backports.*||' %v", tempFile))
-
-		sshCommand(client, fmt.Sprintf("mv %v %v", tempFile, sourcesFilePath))
-		printDiffHeader()
-		sshCommand(client, fmt.Sprintf("diff -y --suppress-common-lines %v.bak %v || true", sourcesFilePath, sourcesFilePath))
-
-	})
-
-	step(&counter, "Updating APT repositories", func() {
-		sshCommand(client, "apt-get update")
-	})
-
-	step(&counter, "Loading firewall rules", func() {
-		sshCommand(client, firewallRulesCommand)
-	})
-
-	installPackage(&counter, client, "docker")
-	installPackage(&counter, client, "curl")
-
-	step(&counter, "Configuring iptables-persistent", func() {
-		sshCommand(client, "echo iptables-persistent iptables-persistent/autosave_v4 boolean true | debconf-set-selections")
-		sshCommand(client, "echo iptables-persistent iptables-persistent/autosave_v6 boolean true | debconf-set-selections")
-	})
-
-	installPackage(&counter, client, "iptables-persistent")
-
-	step(&counter, "Installing pack", func() {
-		pack028TarSha := "4f51b82dea355cffc62b7588a2dfa461e26621dda3821034830702e5cae6f587"
-		pack028BinSha := "01b42a9125418ff46e7ed06ccdc38f9f28e6c0d31e07a39791cf633f8ec5e6e0"
-
-		_, err := client.Exec("[ -f /usr/local/bin/pack ]")
-		assertAnyErrWasDueToNonZeroExitCode(err, "Could not check if 'pack' already exists.")
-		if err == nil {
-			out, err := client.Exec("sha256sum /usr/local/bin/pack | awk '{print $1}'")
-			AssertNoErr(err, "Could not check hash of already downloaded 'pack'")
-
-			if strings.TrimSpace(string(out)) == pack028BinSha {
-				printSubStepInformation(fmt.Sprintf("%v'pack' was previously installed.", LINE_PADDING))
+		arch := detectArchitecture(client)
+		PrintSubStepInformation(fmt.Sprintf("%vFound %v.", LINE_PADDING, arch))
+
+		for _, supported := range supportedArchitectures {
+			if arch == supported {
+				target.arch = arch
+				if *Flags.Setup.PackVersion != "" {
+					findPackArtifact(*Flags.Setup.PackVersion, arch)
+				}
 				return
 			}
-
-			printSubStepInformation(fmt.Sprintf("%v'pack' was downloaded previously, but is corrupt. Re-downloading.", LINE_PADDING))
-		} else {
-			printSubStepInformation(fmt.Sprintf("%v'pack' was not previously downloaded.", LINE_PADDING))
-		}
-
-		fileName := "pack-v0.28.0-linux.tgz"
-		curlCommand(client, fmt.Sprintf("-m 20 -O -f -L --progress-bar https://github.com/buildpacks/pack/releases/download/v0.28.0/%v", fileName))
-
-		out, err := client.Exec(fmt.Sprintf("sha256sum %v | awk '{print $1}'", fileName))
-		AssertNoErr(err, "Could not get hash of pack-cli tarball.")
-
-		if strings.TrimSpace(string(out)) != pack028TarSha {
-			printMessageAndQuit("'pack-cli' tarball is corrupt, or someone is doing something sneaky.")
 		}
-
-		_, err = client.Exec(fmt.Sprintf("tar xvf %v", fileName))
-		AssertNoErr(err, "Could not un-tar pack.")
-		sshCommand(client, "mv pack /usr/local/bin/pack")
-		sshCommand(client, "chmod +x /usr/local/bin/pack")
-	})
-
-	step(&counter, "Persisting firewall rules", func() {
-		sshCommand(client, "echo iptables-persistent iptables-persistent/autosave_v4 boolean true | debconf-set-selections")
-		sshCommand(client, "echo iptables-persistent iptables-persistent/autosave_v6 boolean true | debconf-set-selections")
-		sshCommand(client, "iptables-save > /etc/iptables/rules.v4")
-		sshCommand(client, "iptables-save > /etc/iptables/rules.v6")
-		printSubStepInformation(fmt.Sprintf("%vIPv4 firewall rules:", LINE_PADDING))
-		sshCommand(client, "cat /etc/iptables/rules.v4")
-		printSubStepInformation(fmt.Sprintf("\n%vIPv6 firewall rules:", LINE_PADDING))
-		sshCommand(client, "cat /etc/iptables/rules.v6")
+		color.Red("'snakeplant' is only supported on %v.", strings.Join(supportedArchitectures, ", "))
+		os.Exit(1)
 	})
 
-	installPackage(&counter, client, "unattended-upgrades")
-
-	step(&counter, "Setting up automatic security updates", func() {
-
-		out, err := client.Exec("mktemp")
-		AssertNoErr(err, "Could not create temp file.")
-
-		tempFile := strings.TrimSpace(string(out))
-
-		// Some good context about this file: https://askubuntu.com/a/878600
-		unattendedUpgradesFilePath := "/etc/apt/apt.conf.d/50unattended-upgrades"
-
-		safeIdempotentCopyFile(client, unattendedUpgradesFilePath, fmt.Sprintf("%v.bak", unattendedUpgradesFilePath))
-
-		sshCommand(client, fmt.Sprintf("cp %v %v", unattendedUpgradesFilePath, tempFile))
-
-		sshCommand(client, fmt.Sprintf("sed -i 's|.*Unattended-Upgrade::Automatic-Reboot \"false\".*|Unattended-Upgrade::Automatic-Reboot \"true\";|' %v", tempFile))
-		sshCommand(client, fmt.Sprintf("sed -i 's|.*Unattended-Upgrade::Automatic-Reboot-WithUsers \"true\".*|Unattended-Upgrade::Automatic-Reboot-WithUsers \"true\";|' %v", tempFile))
-		sshCommand(client, fmt.Sprintf("sed -i 's|.*Unattended-Upgrade::Automatic-Reboot-Time \"02:00\".*|Unattended-Upgrade::Automatic-Reboot-Time \"%v\";|' %v", *Flags.Setup.RebootTime, tempFile))
-
-		sshCommand(client, fmt.Sprintf("sed -i 's|.*Unattended-Upgrade::SyslogEnable \"false\".*|Unattended-Upgrade::SyslogEnable \"true\";|' %v", tempFile))
-		sshCommand(client, fmt.Sprintf("sed -i 's|.*Unattended-Upgrade::Verbose \"false\".*|Unattended-Upgrade::Verbose \"true\";|' %v", tempFile))
-
-		sshCommand(client, fmt.Sprintf("mv %v %v", tempFile, unattendedUpgradesFilePath))
-
-		printDiffHeader()
-		sshCommand(client, fmt.Sprintf("diff -y --suppress-common-lines %v.bak %v || true", unattendedUpgradesFilePath, unattendedUpgradesFilePath))
-	})
+	backend := chooseFirewallBackend(*Flags.Setup.FirewallBackend, target)
+	PrintSubStepInformation(fmt.Sprintf("Using %v for the firewall.", backend))
+	// The reboot window is in whatever timezone the server ends up in.
+	if timezone == nil {
+		timezone = detectTimezone(client)
+	}
+	window.describe(timezone)
+
+	// Rules added with 'snakeplant firewall allow' are kept.
+	if saved, ok := readSavedFirewall(client); ok {
+		policy.mergeSavedRules(saved.Policy)
+	}
+
+	reconnect := func() (*simplessh.Client, error) {
+		return simplessh.ConnectWithKeyFileTimeout(socket, "root", *Flags.Setup.Key, 5*time.Second)
+	}
+
+	steps := setupSteps(client, target, backend, policy, upgrades, window, docker, sources, protection, artifacts, reconnect)
+	if *Flags.Setup.Plan {
+		planSteps(client, steps, *Flags.Setup.Only, *Flags.Setup.Skip, *Flags.Setup.Force)
+		return
+	}
+	runSteps(&counter, client, steps, *Flags.Setup.Only, *Flags.Setup.Skip, *Flags.Setup.Force)
 
 	color.HiBlue("Setup is complete. Your server is now ready to use!")
 }
 
-var firewallRulesCommand = `iptables-restore <<-'EOF'
-*filter
-:INPUT ACCEPT [0:0]
-:FORWARD ACCEPT [0:0]
-:OUTPUT ACCEPT [0:0]
--A INPUT -m state --state RELATED,ESTABLISHED -j ACCEPT
--A INPUT -p tcp -m state --state NEW -m tcp -m multiport --dports 80,443,444 -j ACCEPT
--A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
--A INPUT -i lo -j ACCEPT
--A INPUT -j REJECT --reject-with icmp-port-unreachable
-COMMIT
-EOF`
+// Everything 'setup' installs with apt, other than docker, which needs its own repository first.
+func setupPackages(target platform, backend firewallBackend, docker dockerOptions, protection sshProtectionOptions) []aptPackage {
+	packages := []aptPackage{
+		{name: target.packageName("curl")},
+		// Needed to read tarballs that were uploaded with '--encrypt'.
+		{name: target.packageName("age")},
+		{name: target.packageName("unattended-upgrades")},
+		ntpPackage(target, *Flags.Setup.NTP),
+	}
+	if docker.engine.official {
+		// For checking the fingerprint of Docker's signing key.
+		packages = append(packages, aptPackage{name: target.packageName("gnupg")})
+	}
+	if protection.mode == "fail2ban" {
+		// The jail reads sshd's log from the journal, which fail2ban only recommends the module for.
+		packages = append(packages, aptPackage{name: target.packageName("fail2ban")}, aptPackage{name: target.packageName("python3-systemd")})
+	}
+	return append(packages, backend.packages(target)...)
+}
+
+// Everything 'setup' does once it knows what it's talking to, in the order it's done.
+func setupSteps(client *simplessh.Client, target platform, backend firewallBackend, policy firewallPolicy, upgrades unattendedUpgradesOptions, window rebootWindow, docker dockerOptions, sources aptSourcesOptions, protection sshProtectionOptions, artifacts map[string]string, reconnect func() (*simplessh.Client, error)) []Step {
+	policyJSON, err := json.Marshal(policy)
+	AssertNoErr(err, "Could not serialize the firewall policy.")
+	firewallInputs := []string{backend.String(), string(policyJSON)}
+
+	steps := sshdPasswordSteps(client, *Flags.Setup.AllowSSHPasswords)
+	if *Flags.Setup.Timezone != "" {
+		steps = append(steps, timezoneStep(client, *Flags.Setup.Timezone))
+	}
+	if *Flags.Setup.Hostname != "" {
+		steps = append(steps, hostnameSteps(client, *Flags.Setup.Hostname)...)
+	}
+
+	updateDependencies := []string{"configure-apt-sources", "configure-apt-proxy"}
+	if *Flags.Setup.ArtifactCache != "" {
+		steps = append(steps, uploadArtifactsStep(client, artifactCache{dir: *Flags.Setup.ArtifactCache}, artifacts))
+		updateDependencies = append(updateDependencies, "upload-artifacts")
+	}
+
+	steps = append(steps, aptSourcesSteps(client, target, sources, *Flags.Setup.AptProxy)...)
+
+	steps = append(steps,
+		Step{
+			Name:        "update-apt",
+			Description: "Updating APT repositories",
+			DependsOn:   updateDependencies,
+			Apply: func() {
+				aptGet(client, "update")
+			},
+		},
+		installPackagesStep(client, mergeAptPackages(setupPackages(target, backend, docker, protection), parseAptPackages(*Flags.Setup.Packages))),
+	)
+
+	steps = append(steps, ntpSteps(client, *Flags.Setup.NTP)...)
+
+	if swapSize := parseSwapSize(*Flags.Setup.SwapSize); swapSize > 0 {
+		steps = append(steps, swapSteps(client, swapSize)...)
+	}
+	steps = append(steps, sysctlSteps(client, webSysctlProfile(*Flags.Setup.Swappiness))...)
+
+	steps = append(steps, backend.installSteps(client, target)...)
+
+	steps = append(steps,
+		Step{
+			Name:        "load-firewall",
+			Description: "Loading firewall rules",
+			DependsOn:   []string{"install-packages"},
+			Inputs:      firewallInputs,
+			Check: func() bool {
+				return len(backend.missingRules(client, policy)) > 0
+			},
+			Apply: func() {
+				applyFirewallPolicy(client, backend, policy, reconnect, time.Duration(*Flags.Setup.FirewallRollbackSeconds)*time.Second)
+			},
+		},
+	)
+
+	steps = append(steps, dockerSteps(client, target, docker)...)
+
+	steps = append(steps,
+		packInstallStep(client, target, *Flags.Setup.PackVersion),
+	)
+
+	steps = append(steps, packBuilderSteps(client, *Flags.Setup.PackBuilder, *Flags.Setup.PackTrustedBuilders)...)
+
+	steps = append(steps,
+		Step{
+			Name:        "persist-firewall",
+			Description: "Persisting firewall rules",
+			DependsOn:   []string{"load-firewall"},
+			Inputs:      firewallInputs,
+			Check: func() bool {
+				saved, ok := readSavedFirewall(client)
+				return !ok || saved.Backend != backend.String() || !reflect.DeepEqual(saved.Policy, policy)
+			},
+			Apply: func() {
+				backend.persist(client, policy)
+				writeSavedFirewall(client, backend, policy)
+			},
+		},
+		Step{
+			Name:        "verify-firewall",
+			Description: "Verifying firewall rules are loaded",
+			DependsOn:   []string{"load-firewall"},
+			// This is what catches rules that went missing since they were loaded, so it's never skipped.
+			AlwaysRun: true,
+			Apply: func() {
+				missing := backend.missingRules(client, policy)
+				if len(missing) > 0 {
+					PrintMessageAndQuit(fmt.Sprintf("These firewall rules should be loaded, but aren't:\n%v%v", LINE_PADDING, strings.Join(missing, "\n"+LINE_PADDING)))
+				}
+				PrintSubStepInformation(fmt.Sprintf("%vAll firewall rules are loaded.", LINE_PADDING))
+			},
+		},
+	)
+	steps = append(steps, sshProtectionSteps(client, backend, policy, protection)...)
+	steps = append(steps,
+		withDependencies(managedFileStep(client, "configure-unattended-upgrades", "Setting up automatic security updates", managedFile{
+			path:  unattendedUpgradesConfPath,
+			owner: "root:root",
+			mode:  0644,
+			render: func(string) string {
+				return upgrades.conf()
+			},
+			validate: upgrades.validate,
+		}, upgrades.conf()), "install-packages"),
+	)
+	steps = append(steps, rebootWindowSteps(client, window)...)
+	return steps
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+	"time"
+)
+
+// fail2ban reads '.local' files after the '.conf' ones the package ships, so these settings win over its defaults.
+const fail2banJailPath = "/etc/fail2ban/jail.d/snakeplant.local"
+
+// The jail that watches sshd's log. It's the same name fail2ban's own defaults use, so there's only ever one.
+const fail2banJail = "sshd"
+
+var sshProtectionModes = []string{"none", "fail2ban", "rate-limit"}
+
+// 'recent' only remembers the last 20 connections from each address, so it can't count any higher than that.
+const maxSSHRateLimit = 19
+
+// How ssh is kept from being brute forced. fail2ban bans an address for a while after too many failed logins. The rate
+// limit is done by the firewall itself, and only looks at how often an address connects, not whether it logs in.
+type sshProtectionOptions struct {
+	mode       string
+	banTime    time.Duration
+	findTime   time.Duration
+	maxRetries int
+	rateLimit  int
+}
+
+func newSSHProtectionOptions() sshProtectionOptions {
+	o := sshProtectionOptions{
+		mode:       *Flags.Setup.SSHProtection,
+		maxRetries: *Flags.Setup.SSHMaxRetries,
+		rateLimit:  *Flags.Setup.SSHRateLimit,
+	}
+	if !containsString(sshProtectionModes, o.mode) {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not a way to protect ssh. It has to be one of: %v.", o.mode, strings.Join(sshProtectionModes, ", ")))
+	}
+	o.banTime = parseSSHProtectionDuration(*Flags.Setup.SSHBanTime, "--ssh-ban-time")
+	o.findTime = parseSSHProtectionDuration(*Flags.Setup.SSHFindTime, "--ssh-find-time")
+	if o.maxRetries < 1 {
+		PrintMessageAndQuit("'--ssh-max-retries' has to be at least 1.")
+	}
+	if o.rateLimit < 1 || o.rateLimit > maxSSHRateLimit {
+		PrintMessageAndQuit(fmt.Sprintf("'--ssh-rate-limit' has to be between 1 and %v.", maxSSHRateLimit))
+	}
+	return o
+}
+
+// fail2ban only takes whole seconds.
+func parseSSHProtectionDuration(value string, flag string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Second || d%time.Second != 0 {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not a length of time for '%v'. It should look like '10m' or '1h'.", value, flag))
+	}
+	return d
+}
+
+// The jail also watches the ssh port, bans with the backend's action and never bans the '--ssh-from' sources, so a
+// change to any of those has to rewrite it too.
+func (o sshProtectionOptions) inputs(backend firewallBackend, policy firewallPolicy) []string {
+	return []string{o.mode, o.banTime.String(), o.findTime.String(), fmt.Sprint(o.maxRetries), backend.String(), fmt.Sprint(policy.SSHPort), strings.Join(policy.SSHSources, ",")}
+}
+
+// Ban actions are named after the firewall they add rules to. fail2ban keeps its rules in its own chains, or its own
+// table for nftables, instead of mixing them in with snakeplant's.
+func fail2banAction(backend firewallBackend) string {
+	return fmt.Sprintf("%v-multiport", backend)
+}
+
+func (o sshProtectionOptions) jailConf(backend firewallBackend, policy firewallPolicy) string {
+	// When ssh is only open to some sources, those are the people it's meant for, so they're never banned.
+	ignored := append([]string{"127.0.0.1/8", "::1"}, policy.SSHSources...)
+
+	return fmt.Sprintf(`# Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs.
+
+[%v]
+enabled = true
+port = %v
+# sshd logs to the journal, and not every server has a syslog daemon writing /var/log/auth.log.
+backend = systemd
+# An address is banned for bantime seconds after maxretry failed logins within findtime seconds.
+maxretry = %v
+findtime = %v
+bantime = %v
+banaction = %v
+ignoreip = %v
+`, fail2banJail, policy.SSHPort, o.maxRetries, int(o.findTime.Seconds()), int(o.banTime.Seconds()), fail2banAction(backend), strings.Join(ignored, " "))
+}
+
+// fail2ban can only check a whole config directory, so the staged jail is tried out in a copy of the real one.
+func validateFail2banJail(client *simplessh.Client, stagedPath string) {
+	out, err := client.Exec(fmt.Sprintf(`dir=$(mktemp -d) && cp -a /etc/fail2ban/. $dir && cp %v $dir/jail.d/snakeplant.local && fail2ban-client -c $dir -t; status=$?; rm -rf $dir; exit $status`, stagedPath))
+	if err != nil {
+		PrintMessageAndQuit(fmt.Sprintf("fail2ban couldn't read the new jail:\n%v%v", LINE_PADDING, strings.TrimSpace(string(out))))
+	}
+	PrintSubStepInformation(fmt.Sprintf("%v'fail2ban-client -t' read the new jail without any problems.", LINE_PADDING))
+}
+
+func fail2banRunning(client *simplessh.Client) bool {
+	_, err := client.Exec("systemctl is-active fail2ban")
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Could not check if fail2ban is running.")
+	return err == nil
+}
+
+// Returns the addresses the ssh jail has banned right now. ok is false if the jail isn't running.
+func fail2banBannedAddresses(client *simplessh.Client) ([]string, bool) {
+	out, err := client.Exec(fmt.Sprintf("fail2ban-client status %v", fail2banJail))
+	if err != nil {
+		return nil, false
+	}
+
+	// The last line of the status looks like '   `- Banned IP list:	203.0.113.7 198.51.100.2'.
+	for _, line := range strings.Split(string(out), "\n") {
+		if _, list, found := strings.Cut(line, "Banned IP list:"); found {
+			return strings.Fields(list), true
+		}
+	}
+	return nil, true
+}
+
+func sshProtectionSteps(client *simplessh.Client, backend firewallBackend, policy firewallPolicy, o sshProtectionOptions) []Step {
+	if o.mode != "fail2ban" {
+		// A jail snakeplant set up before is taken out. fail2ban itself is left installed, since something else could be
+		// using it.
+		return []Step{
+			{
+				Name:        "configure-fail2ban",
+				Description: "Removing snakeplant's fail2ban jail",
+				Inputs:      []string{o.mode},
+				Check: func() bool {
+					_, exists := readRemoteFile(client, fail2banJailPath)
+					return exists
+				},
+				Diff: func() string {
+					current, _ := readRemoteFile(client, fail2banJailPath)
+					return unifiedDiff(fail2banJailPath+" (before)", fail2banJailPath+" (after)", current, "")
+				},
+				Apply: func() {
+					current, _ := readRemoteFile(client, fail2banJailPath)
+					SSHCommand(client, fmt.Sprintf("rm -f %v", fail2banJailPath))
+					printUnifiedDiff(unifiedDiff(fail2banJailPath+" (before)", fail2banJailPath+" (after)", current, ""))
+					if fail2banRunning(client) {
+						SSHCommand(client, "fail2ban-client reload")
+						color.Yellow("%vfail2ban is still running with its own settings. If you don't need it anymore, remove it with 'apt-get purge fail2ban'.", LINE_PADDING)
+					}
+				},
+			},
+		}
+	}
+
+	jail := managedFile{
+		path:  fail2banJailPath,
+		owner: "root:root",
+		mode:  0644,
+		render: func(string) string {
+			return o.jailConf(backend, policy)
+		},
+		validate: validateFail2banJail,
+	}
+	configure := withDependencies(managedFileStep(client, "configure-fail2ban", "Configuring fail2ban's ssh jail", jail, o.inputs(backend, policy)...), "install-packages")
+	configure.Apply = func() {
+		jail.apply(client)
+		// Without a reload, fail2ban keeps going with the settings it started with.
+		if fail2banRunning(client) {
+			SSHCommand(client, "fail2ban-client reload")
+		}
+	}
+
+	return []Step{
+		configure,
+		{
+			Name:        "enable-fail2ban",
+			Description: "Turning on fail2ban",
+			DependsOn:   []string{"configure-fail2ban"},
+			Check: func() bool {
+				return !fail2banRunning(client)
+			},
+			Apply: func() {
+				PrintSubStepInformation(fmt.Sprintf("%vfail2ban is '%v', and should be 'active'.", LINE_PADDING, activeState(client, "fail2ban")))
+				SSHCommand(client, "systemctl enable --now fail2ban")
+			},
+		},
+		{
+			Name:        "verify-fail2ban",
+			Description: "Verifying fail2ban is watching ssh",
+			DependsOn:   []string{"enable-fail2ban"},
+			// fail2ban can be running without the jail, if it couldn't read sshd's log.
+			AlwaysRun: true,
+			Apply: func() {
+				// It takes a moment after starting before the jail answers.
+				for i := 0; i < 10; i++ {
+					if banned, ok := fail2banBannedAddresses(client); ok {
+						PrintSubStepInformation(fmt.Sprintf("%vThe '%v' jail is running, and has %v addresses banned. 'snakeplant bans list' shows them.", LINE_PADDING, fail2banJail, len(banned)))
+						return
+					}
+					time.Sleep(time.Second)
+				}
+				PrintMessageAndQuit(fmt.Sprintf("fail2ban's '%v' jail isn't running. 'journalctl -u fail2ban' on the server should say why.", fail2banJail))
+			},
+		},
+	}
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+)
+
+// sshd keeps the first value it reads for a setting, and reads sshd_config.d in order, so this has to sort before
+// anything else in there. cloud-init's '50-cloud-init.conf' turns passwords back on, for example.
+const sshdPasswordsConfPath = "/etc/ssh/sshd_config.d/01-snakeplant.conf"
+
+const sshdPasswordsConf = `# Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs.
+# Only keys can be used to log in. Passwords can be guessed, and the whole internet is trying.
+PasswordAuthentication no
+KbdInteractiveAuthentication no
+`
+
+// The settings sshd would actually use, as 'sshd -T' prints them, like 'passwordauthentication' -> 'no'. configPath is
+// the main config file to start from.
+func effectiveSshdConfig(client *simplessh.Client, configPath string) map[string]string {
+	out, err := client.Exec(fmt.Sprintf("sshd -T -f %v", configPath))
+	if err != nil {
+		PrintMessageAndQuit(fmt.Sprintf("sshd couldn't read its config:\n%v%v", LINE_PADDING, strings.TrimSpace(string(out))))
+	}
+
+	settings := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if ok {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+func sshdAllowsPasswords(settings map[string]string) bool {
+	return settings["passwordauthentication"] != "no" || settings["kbdinteractiveauthentication"] != "no"
+}
+
+// The staged file is tried out by a main config that reads it first, and then everything the real one reads, which is
+// where it'll end up once it's in sshd_config.d.
+func validateSshdPasswordsConf(client *simplessh.Client, stagedPath string) {
+	mainConfig := stagedPath + ".main"
+	WriteRemoteFile(client, mainConfig, []byte(fmt.Sprintf("Include %v\nInclude /etc/ssh/sshd_config\n", stagedPath)), 0644)
+	defer client.Exec(fmt.Sprintf("rm -f %v", mainConfig))
+
+	if sshdAllowsPasswords(effectiveSshdConfig(client, mainConfig)) {
+		PrintMessageAndQuit(fmt.Sprintf("sshd would still allow passwords with %v in place. Something in /etc/ssh/sshd_config is overriding it.", sshdPasswordsConfPath))
+	}
+	PrintSubStepInformation(fmt.Sprintf("%v'sshd -T' shows password logins turned off.", LINE_PADDING))
+}
+
+// setup only ever logs in with a key, so turning passwords off can't lock it out.
+func sshdPasswordSteps(client *simplessh.Client, allowPasswords bool) []Step {
+	if allowPasswords {
+		// The drop-in from a run before is taken out, so passwords go back to whatever the rest of sshd's config says.
+		return []Step{
+			{
+				Name:        "disable-ssh-passwords",
+				Description: "Turning ssh password logins back on",
+				Inputs:      []string{"allowed"},
+				Check: func() bool {
+					_, exists := readRemoteFile(client, sshdPasswordsConfPath)
+					return exists
+				},
+				Diff: func() string {
+					current, _ := readRemoteFile(client, sshdPasswordsConfPath)
+					return unifiedDiff(sshdPasswordsConfPath+" (before)", sshdPasswordsConfPath+" (after)", current, "")
+				},
+				Apply: func() {
+					current, _ := readRemoteFile(client, sshdPasswordsConfPath)
+					SSHCommand(client, fmt.Sprintf("rm -f %v", sshdPasswordsConfPath))
+					printUnifiedDiff(unifiedDiff(sshdPasswordsConfPath+" (before)", sshdPasswordsConfPath+" (after)", current, ""))
+					SSHCommand(client, "systemctl try-reload-or-restart ssh")
+					if !sshdAllowsPasswords(effectiveSshdConfig(client, "/etc/ssh/sshd_config")) {
+						color.Yellow("%vsshd still doesn't allow passwords. Something else in /etc/ssh/sshd_config turns them off.", LINE_PADDING)
+					}
+				},
+			},
+		}
+	}
+
+	file := managedFile{
+		path:  sshdPasswordsConfPath,
+		owner: "root:root",
+		mode:  0644,
+		render: func(string) string {
+			return sshdPasswordsConf
+		},
+		validate: validateSshdPasswordsConf,
+	}
+	disable := managedFileStep(client, "disable-ssh-passwords", "Turning off ssh password logins", file)
+	disable.Apply = func() {
+		file.apply(client)
+		// Sessions that are already open, like this one, aren't affected. Does nothing if sshd is only started when a
+		// connection comes in, since it reads the config every time then.
+		SSHCommand(client, "systemctl try-reload-or-restart ssh")
+	}
+
+	return []Step{
+		disable,
+		{
+			Name:        "verify-ssh-passwords",
+			Description: "Verifying ssh password logins are off",
+			DependsOn:   []string{"disable-ssh-passwords"},
+			// Another file in sshd_config.d can turn them back on at any time.
+			AlwaysRun: true,
+			Apply: func() {
+				if sshdAllowsPasswords(effectiveSshdConfig(client, "/etc/ssh/sshd_config")) {
+					PrintMessageAndQuit(fmt.Sprintf("sshd still allows password logins, even with %v in place.", sshdPasswordsConfPath))
+				}
+				PrintSubStepInformation(fmt.Sprintf("%vOnly keys can be used to log in.", LINE_PADDING))
+			},
+		},
+	}
+}
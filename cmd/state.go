@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+	"time"
+)
+
+// Which setup steps have finished, so running setup again can pick up where it left off instead of redoing
+// everything.
+const setupStatePath = "/var/local/snakeplant/state.json"
+
+type completedStep struct {
+	InputsHash  string    `json:"inputsHash"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+type setupState struct {
+	Steps map[string]completedStep `json:"steps"`
+}
+
+func (s Step) inputsHash() string {
+	// The NUL keeps '["ab", "c"]' and '["a", "bc"]' from hashing the same.
+	sum := sha256.Sum256([]byte(strings.Join(s.Inputs, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns when s last finished, if it did with the same inputs it has now.
+func (state setupState) completed(s Step) (time.Time, bool) {
+	done, ok := state.Steps[s.Name]
+	if !ok || done.InputsHash != s.inputsHash() {
+		return time.Time{}, false
+	}
+	return done.CompletedAt, true
+}
+
+func (state *setupState) markCompleted(s Step) {
+	state.Steps[s.Name] = completedStep{InputsHash: s.inputsHash(), CompletedAt: time.Now().UTC()}
+}
+
+// With force, every step runs again anyway, but the file is still read so the steps that aren't run this time, like with
+// '--only', keep their records. Only a corrupt file is started over from nothing.
+func readSetupState(client *simplessh.Client, force bool) setupState {
+	state := setupState{Steps: map[string]completedStep{}}
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", setupStatePath))
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for the setup state file.")
+	if err != nil {
+		return state
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", setupStatePath))
+	AssertNoErr(err, fmt.Sprintf("Could not read %v.", setupStatePath))
+
+	err = json.Unmarshal(out, &state)
+	if err != nil && force {
+		color.Yellow("%v%v is corrupt, so it's started over. Steps that don't run this time will run again next time.", LINE_PADDING, setupStatePath)
+		return setupState{Steps: map[string]completedStep{}}
+	}
+	AssertNoErr(err, fmt.Sprintf("%v is corrupt. Delete it, or run setup with '--force'.", setupStatePath))
+
+	if state.Steps == nil {
+		state.Steps = map[string]completedStep{}
+	}
+	return state
+}
+
+func writeSetupState(client *simplessh.Client, state setupState) {
+	content, err := json.MarshalIndent(state, "", "  ")
+	AssertNoErr(err, "Could not serialize the setup state.")
+
+	_, err = client.Exec("mkdir -p /var/local/snakeplant")
+	AssertNoErr(err, "Unable to create /var/local/snakeplant.")
+	WriteRemoteFile(client, setupStatePath, append(content, '\n'), 0644)
+}
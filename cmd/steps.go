@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+	"time"
+)
+
+// One thing 'setup' does to the server.
+type Step struct {
+	// What '--only' and '--skip' take, like 'install-pack'.
+	Name string
+	// Printed while the step runs, like "Installing pack".
+	Description string
+	// Names of steps that have to be done before this one can be. They have to come earlier in the list too.
+	DependsOn []string
+	// Everything that changes what Apply does, like flag values. A step that finished before is only skipped if these
+	// are the same as they were then.
+	Inputs []string
+	// Runs even when it finished before, for steps that are cheap and worth repeating, like verifying things.
+	AlwaysRun bool
+	// Reports whether Apply has anything to do. It can't change anything on the server, since '--plan' runs it to
+	// preview what would happen. A step without a Check always runs.
+	Check func() bool
+	// Optional. What Apply would change, as a unified diff, so '--plan' can show it.
+	Diff  func() string
+	Apply func()
+}
+
+func (s Step) needsApply() bool {
+	return s.Check == nil || s.Check()
+}
+
+func validateSteps(steps []Step) map[string]Step {
+	byName := map[string]Step{}
+	for _, s := range steps {
+		if _, ok := byName[s.Name]; ok {
+			panic(fmt.Sprintf("there are two steps named '%v'", s.Name))
+		}
+		for _, dependency := range s.DependsOn {
+			if _, ok := byName[dependency]; !ok {
+				panic(fmt.Sprintf("step '%v' depends on '%v', which doesn't come before it", s.Name, dependency))
+			}
+		}
+		byName[s.Name] = s
+	}
+	return byName
+}
+
+func stepNames(steps []Step) string {
+	names := make([]string, len(steps))
+	for i, s := range steps {
+		names[i] = s.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Which steps '--only' and '--skip' leave in. An empty only means every step.
+func selectSteps(steps []Step, byName map[string]Step, only []string, skip []string) map[string]bool {
+	for _, name := range append(append([]string{}, only...), skip...) {
+		if _, ok := byName[name]; !ok {
+			PrintMessageAndQuit(fmt.Sprintf("There's no step called '%v'. The steps are: %v.", name, stepNames(steps)))
+		}
+	}
+
+	selected := map[string]bool{}
+	for _, s := range steps {
+		selected[s.Name] = len(only) == 0 || containsString(only, s.Name)
+	}
+	for _, name := range skip {
+		selected[name] = false
+	}
+	return selected
+}
+
+// Returns the steps that were left out, but that a selected step needs and that haven't been done yet. Steps without a
+// Check are left out of this, since there's no way to tell if they've been done.
+func unmetDependencies(steps []Step, byName map[string]Step, selected map[string]bool) map[string][]string {
+	checked := map[string]bool{}
+	needsApply := func(s Step) bool {
+		if _, ok := checked[s.Name]; !ok {
+			checked[s.Name] = s.Check != nil && s.Check()
+		}
+		return checked[s.Name]
+	}
+
+	unmet := map[string][]string{}
+	for _, s := range steps {
+		if !selected[s.Name] {
+			continue
+		}
+
+		seen := map[string]bool{}
+		pending := append([]string{}, s.DependsOn...)
+		for len(pending) > 0 {
+			name := pending[0]
+			pending = pending[1:]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			dependency := byName[name]
+			if !selected[name] && needsApply(dependency) {
+				unmet[s.Name] = append(unmet[s.Name], name)
+			}
+			pending = append(pending, dependency.DependsOn...)
+		}
+	}
+	return unmet
+}
+
+// A step is resumed (skipped without even running its Check) if it finished before with the same inputs, and nothing it
+// depends on had to be applied this time around.
+func (state setupState) resumable(s Step, applied map[string]bool, force bool) (time.Time, bool) {
+	if force || s.AlwaysRun {
+		return time.Time{}, false
+	}
+	for _, dependency := range s.DependsOn {
+		if applied[dependency] {
+			return time.Time{}, false
+		}
+	}
+	return state.completed(s)
+}
+
+// Runs every selected step in order, skipping the ones that were already done. Every step that finishes is recorded
+// in the state file right away, so if setup is interrupted, the next run starts from where this one stopped.
+func runSteps(counter *int, client *simplessh.Client, steps []Step, only []string, skip []string, force bool) {
+	byName := validateSteps(steps)
+	selected := selectSteps(steps, byName, only, skip)
+
+	// Checked before anything runs, so that leaving out the wrong step doesn't stop setup halfway through.
+	unmet := unmetDependencies(steps, byName, selected)
+	for _, s := range steps {
+		if dependencies, ok := unmet[s.Name]; ok {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' needs '%v' to be done first, but it was left out by '--only' or '--skip'.", s.Name, strings.Join(dependencies, "', '")))
+		}
+	}
+
+	state := readSetupState(client, force)
+	applied := map[string]bool{}
+	for _, s := range steps {
+		if !selected[s.Name] {
+			continue
+		}
+
+		step(counter, s.Description, func() {
+			if completedAt, ok := state.resumable(s, applied, force); ok {
+				PrintSubStepInformation(fmt.Sprintf("%vFinished on %v and nothing it depends on has changed since, so it's skipped. '--force' runs it again.", LINE_PADDING, completedAt.Local().Format(time.RFC1123)))
+				return
+			}
+
+			if !s.needsApply() {
+				PrintSubStepInformation(fmt.Sprintf("%vAlready done, so there's nothing to change.", LINE_PADDING))
+			} else {
+				s.Apply()
+				applied[s.Name] = true
+			}
+
+			state.markCompleted(s)
+			writeSetupState(client, state)
+		})
+	}
+}
+
+// Runs only the checks, and prints what running the steps would do.
+func planSteps(client *simplessh.Client, steps []Step, only []string, skip []string, force bool) {
+	byName := validateSteps(steps)
+	selected := selectSteps(steps, byName, only, skip)
+	unmet := unmetDependencies(steps, byName, selected)
+	state := readSetupState(client, force)
+
+	// Steps that would change something make the steps that depend on them run again, the same way runSteps does.
+	applied := map[string]bool{}
+
+	changes := 0
+	color.HiBlue("Plan. Nothing has been changed on your server.")
+	for _, s := range steps {
+		label := fmt.Sprintf("%v%v (%v)", LINE_PADDING, s.Description, s.Name)
+		switch {
+		case !selected[s.Name]:
+			fmt.Printf("%v: left out\n", label)
+		case resumed(state, s, applied, force):
+			color.Green("%v: finished before, so it would be skipped", label)
+		case s.Check == nil:
+			changes++
+			applied[s.Name] = true
+			color.Yellow("%v: always runs", label)
+		case s.Check():
+			changes++
+			applied[s.Name] = true
+			color.Yellow("%v: would change something", label)
+			if s.Diff != nil {
+				printUnifiedDiff(s.Diff())
+			}
+		default:
+			color.Green("%v: already done", label)
+		}
+
+		if dependencies, ok := unmet[s.Name]; ok {
+			color.Red("%v%vneeds '%v' to be done first, but it was left out", LINE_PADDING, LINE_PADDING, strings.Join(dependencies, "', '"))
+		}
+	}
+
+	// Checks look at the server the way it is now. A step can look done and still change once the steps before it run.
+	PrintSubStepInformation(fmt.Sprintf("%v of %v steps would run. Checks are made against the server as it is now, so steps after one that changes something could end up changing something too.", changes, len(steps)))
+}
+
+func resumed(state setupState, s Step, applied map[string]bool, force bool) bool {
+	_, ok := state.resumable(s, applied, force)
+	return ok
+}
+
+// Adds to the steps that s depends on.
+func withDependencies(s Step, names ...string) Step {
+	s.DependsOn = append(append([]string{}, s.DependsOn...), names...)
+	return s
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"strconv"
+	"strings"
+)
+
+const swapFilePath = "/swapfile"
+
+// Anything smaller isn't worth the disk space, and mkswap refuses files that are only a few pages long.
+const minSwapSize = 64 << 20
+
+// Parses '--swap-size' and rounds it down to whole megabytes, so 'dd' can make exactly the same size as 'fallocate'. 0
+// means no swap file.
+func parseSwapSize(value string) int64 {
+	size := ParseSize(value, "--swap-size") >> 20 << 20
+	if size != 0 && size < minSwapSize {
+		PrintMessageAndQuit(fmt.Sprintf("'--swap-size' has to be '0' or at least %vMB.", minSwapSize>>20))
+	}
+	return size
+}
+
+func swapFileSize(client *simplessh.Client) (int64, bool) {
+	out, err := client.Exec(fmt.Sprintf("stat -c %%s %v", swapFilePath))
+	if err != nil {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	return size, err == nil
+}
+
+func swapFileActive(client *simplessh.Client) bool {
+	out, err := client.Exec("swapon --show=NAME --noheadings")
+	AssertNoErr(err, "Could not list the active swap.")
+	for _, name := range strings.Fields(string(out)) {
+		if name == swapFilePath {
+			return true
+		}
+	}
+	return false
+}
+
+func describeSwap(client *simplessh.Client) string {
+	size, exists := swapFileSize(client)
+	switch {
+	case !exists:
+		return fmt.Sprintf("there's no %v", swapFilePath)
+	case swapFileActive(client):
+		return fmt.Sprintf("%v is %vMB and in use", swapFilePath, size>>20)
+	default:
+		return fmt.Sprintf("%v is %vMB and not in use", swapFilePath, size>>20)
+	}
+}
+
+// There's only ever one entry for the swap file, no matter what was there before.
+func fstabWithSwapFile(current string) string {
+	var lines []string
+	for _, line := range splitLines(current) {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == swapFilePath {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("%v none swap sw 0 0", swapFilePath))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Small servers don't have enough memory for 'pack build' on its own, and without swap the build gets OOM-killed.
+func swapSteps(client *simplessh.Client, size int64) []Step {
+	format := func() {
+		SSHCommand(client, fmt.Sprintf("chmod 600 %v", swapFilePath))
+		SSHCommand(client, fmt.Sprintf("mkswap %v", swapFilePath))
+	}
+
+	return []Step{
+		{
+			Name:        "create-swap-file",
+			Description: "Creating the swap file",
+			Inputs:      []string{strconv.FormatInt(size, 10)},
+			Check: func() bool {
+				current, exists := swapFileSize(client)
+				return !exists || current != size || !swapFileActive(client)
+			},
+			Apply: func() {
+				PrintSubStepInformation(fmt.Sprintf("%vRight now %v. It should be %vMB and in use.", LINE_PADDING, describeSwap(client), size>>20))
+
+				if current, exists := swapFileSize(client); !exists || current != size {
+					if swapFileActive(client) {
+						SSHCommand(client, fmt.Sprintf("swapoff %v", swapFilePath))
+					}
+
+					// fallocate is instant, but on some filesystems it leaves the file with holes, and it's swapon that
+					// complains, not fallocate. dd writes every block, so it's slow but always works.
+					SSHCommand(client, fmt.Sprintf("rm -f %v", swapFilePath))
+					_, err := client.Exec(fmt.Sprintf("fallocate -l %v %v", size, swapFilePath))
+					AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while creating the swap file.")
+					if err == nil {
+						format()
+						_, err = client.Exec(fmt.Sprintf("swapon %v", swapFilePath))
+						AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while turning on the swap file.")
+					}
+					if err != nil {
+						PrintSubStepInformation(fmt.Sprintf("%vA swap file made with fallocate can't be used here, so it's being written out with dd instead.", LINE_PADDING))
+						SSHCommand(client, fmt.Sprintf("rm -f %v", swapFilePath))
+						SSHCommand(client, fmt.Sprintf("dd if=/dev/zero of=%v bs=1M count=%v", swapFilePath, size>>20))
+						format()
+					}
+				}
+
+				if !swapFileActive(client) {
+					SSHCommand(client, fmt.Sprintf("swapon %v", swapFilePath))
+				}
+			},
+		},
+		withDependencies(managedFileStep(client, "add-swap-to-fstab", "Turning swap on at boot", managedFile{
+			path:   "/etc/fstab",
+			owner:  "root:root",
+			mode:   0644,
+			render: fstabWithSwapFile,
+		}), "create-swap-file"),
+	}
+}
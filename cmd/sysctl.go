@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"strconv"
+	"strings"
+)
+
+const sysctlProfilePath = "/etc/sysctl.d/60-snakeplant.conf"
+
+type sysctlSetting struct {
+	key   string
+	value string
+	// The value is a floor. If the kernel already has something bigger (newer kernels and servers with more memory
+	// often do), that's kept instead of lowering it.
+	atLeast bool
+	why     string
+}
+
+func webSysctlProfile(swappiness int) []sysctlSetting {
+	return []sysctlSetting{
+		{"vm.swappiness", strconv.Itoa(swappiness), false, "Only swap when memory is actually running out, so swap is a safety net instead of a slowdown."},
+		{"fs.file-max", "1048576", true, "Every connection is an open file, so this is the most connections the whole server can have open."},
+		{"fs.nr_open", "1048576", true, "The most open files a single process can ask for."},
+		{"net.core.somaxconn", "4096", true, "How many connections can wait to be accepted before new ones are turned away."},
+		{"net.ipv4.tcp_max_syn_backlog", "4096", true, "How many half-open connections are remembered, which helps during bursts of traffic."},
+		// Only exists once the conntrack module is loaded, which the firewall and docker both do.
+		{"net.netfilter.nf_conntrack_max", "262144", true, "How many connections the firewall can track before it starts dropping packets."},
+	}
+}
+
+func liveSysctlValue(client *simplessh.Client, key string) (string, bool) {
+	out, err := client.Exec(fmt.Sprintf("sysctl -n %v", key))
+	if err != nil {
+		return "", false
+	}
+	// Some values, like port ranges, are separated by tabs.
+	return strings.Join(strings.Fields(string(out)), " "), true
+}
+
+// Works out the values that should be set, given what the kernel has now.
+func resolveSysctlProfile(client *simplessh.Client, profile []sysctlSetting) []sysctlSetting {
+	resolved := make([]sysctlSetting, len(profile))
+	for i, setting := range profile {
+		resolved[i] = setting
+		if !setting.atLeast {
+			continue
+		}
+
+		live, ok := liveSysctlValue(client, setting.key)
+		if !ok {
+			continue
+		}
+		liveValue, liveErr := strconv.ParseInt(live, 10, 64)
+		desiredValue, desiredErr := strconv.ParseInt(setting.value, 10, 64)
+		if liveErr == nil && desiredErr == nil && liveValue > desiredValue {
+			resolved[i].value = live
+		}
+	}
+	return resolved
+}
+
+func sysctlProfileConf(profile []sysctlSetting) string {
+	lines := []string{"# Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs."}
+	for _, setting := range profile {
+		lines = append(lines, "", fmt.Sprintf("# %v", setting.why), fmt.Sprintf("%v = %v", setting.key, setting.value))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Returns 'key: current -> desired' for every live value that's different than it should be.
+func sysctlDifferences(client *simplessh.Client, profile []sysctlSetting) []string {
+	var differences []string
+	for _, setting := range profile {
+		live, ok := liveSysctlValue(client, setting.key)
+		if !ok {
+			// Can't be set until the kernel module it belongs to is loaded.
+			continue
+		}
+		if live != setting.value {
+			differences = append(differences, fmt.Sprintf("%v: %v -> %v", setting.key, live, setting.value))
+		}
+	}
+	return differences
+}
+
+func sysctlSteps(client *simplessh.Client, profile []sysctlSetting) []Step {
+	file := managedFile{
+		path:  sysctlProfilePath,
+		owner: "root:root",
+		mode:  0644,
+		render: func(string) string {
+			return sysctlProfileConf(resolveSysctlProfile(client, profile))
+		},
+	}
+
+	return []Step{
+		{
+			Name:        "tune-sysctl",
+			Description: "Tuning the kernel for web traffic",
+			Inputs:      []string{sysctlProfileConf(profile)},
+			Check: func() bool {
+				return file.needsChange(client) || len(sysctlDifferences(client, resolveSysctlProfile(client, profile))) > 0
+			},
+			Apply: func() {
+				resolved := resolveSysctlProfile(client, profile)
+				differences := sysctlDifferences(client, resolved)
+				if len(differences) > 0 {
+					PrintSubStepInformation(fmt.Sprintf("%vKernel settings that are different right now:\n%v%v", LINE_PADDING, LINE_PADDING+LINE_PADDING, strings.Join(differences, "\n"+LINE_PADDING+LINE_PADDING)))
+				}
+
+				if file.needsChange(client) {
+					file.apply(client)
+				}
+				// '-e' skips settings whose kernel module isn't loaded yet. They're set at boot once it is.
+				SSHCommand(client, fmt.Sprintf("sysctl -e -p %v", sysctlProfilePath))
+			},
+		},
+	}
+}
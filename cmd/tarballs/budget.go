@@ -0,0 +1,153 @@
+package tarballs
+
+import (
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const sizeReportLength = 5
+
+type uploadFile struct {
+	path string
+	// Slash separated and relative to the root of the upload. This is what goes into the tarball.
+	name string
+	size int64
+}
+
+func collectFiles(wd string) []uploadFile {
+	rules := loadIgnoreRules(wd)
+
+	var files []uploadFile
+	filepath.Walk(wd, func(path string, info fs.FileInfo, err error) error {
+		cmd.AssertNoErr(err, fmt.Sprintf("Could not walk into %v.", path))
+
+		if path == wd {
+			return nil
+		}
+
+		if strings.Contains(path, ".git") {
+			//TODO: we could use the gitignore to filter out other junk
+			return nil
+		}
+
+		name := filepath.ToSlash(path[len(wd)+1:])
+		if rules.ignored(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		files = append(files, uploadFile{path: path, name: name, size: info.Size()})
+		return nil
+	})
+	return files
+}
+
+func totalSize(files []uploadFile) int64 {
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	return total
+}
+
+type sizedName struct {
+	name string
+	size int64
+}
+
+func largestFiles(files []uploadFile) []sizedName {
+	sized := make([]sizedName, len(files))
+	for i, file := range files {
+		sized[i] = sizedName{name: file.name, size: file.size}
+	}
+	return sortBySize(sized)
+}
+
+// Only looks at top level directories. Counting every nested directory would just show the same tree over and over,
+// since a parent is always at least as big as its biggest child.
+func largestDirectories(files []uploadFile) []sizedName {
+	sizes := map[string]int64{}
+	for _, file := range files {
+		if i := strings.Index(file.name, "/"); i != -1 {
+			sizes[file.name[:i]+"/"] += file.size
+		}
+	}
+
+	sized := make([]sizedName, 0, len(sizes))
+	for name, size := range sizes {
+		sized = append(sized, sizedName{name: name, size: size})
+	}
+	return sortBySize(sized)
+}
+
+func sortBySize(sized []sizedName) []sizedName {
+	sort.Slice(sized, func(i, j int) bool {
+		if sized[i].size == sized[j].size {
+			return sized[i].name < sized[j].name
+		}
+		return sized[i].size > sized[j].size
+	})
+	if len(sized) > sizeReportLength {
+		return sized[:sizeReportLength]
+	}
+	return sized
+}
+
+func printSizeReport(files []uploadFile) {
+	cmd.PrintSubStepInformation(fmt.Sprintf("%v files, %v before compression.", len(files), humanSize(totalSize(files))))
+
+	if dirs := largestDirectories(files); len(dirs) > 0 {
+		cmd.PrintSubStepInformation("Largest directories:")
+		for _, dir := range dirs {
+			fmt.Printf("%v%10v  %v\n", cmd.LINE_PADDING, humanSize(dir.size), dir.name)
+		}
+	}
+
+	if largest := largestFiles(files); len(largest) > 0 {
+		cmd.PrintSubStepInformation("Largest files:")
+		for _, file := range largest {
+			fmt.Printf("%v%10v  %v\n", cmd.LINE_PADDING, humanSize(file.size), file.name)
+		}
+	}
+}
+
+func checkSizeBudget(files []uploadFile) {
+	maxSize := cmd.ParseSize(*cmd.Flags.Upload.MaxSize, "--max-size")
+	maxFileSize := cmd.ParseSize(*cmd.Flags.Upload.MaxFileSize, "--max-file-size")
+
+	var offenders []string
+	for _, file := range files {
+		if maxFileSize > 0 && file.size > maxFileSize {
+			offenders = append(offenders, file.name)
+		}
+	}
+
+	if len(offenders) > 0 {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("%v file(s) are bigger than the %v limit set by '--max-file-size'. If they don't need to be deployed, add them to %v:\n\n%v%v",
+			len(offenders), humanSize(maxFileSize), ignoreFileName, cmd.LINE_PADDING, strings.Join(offenders, "\n"+cmd.LINE_PADDING)))
+	}
+
+	if total := totalSize(files); maxSize > 0 && total > maxSize {
+		// The biggest directories and files are the most likely culprits, so those are what we suggest ignoring.
+		var suggestions []string
+		for _, dir := range largestDirectories(files) {
+			suggestions = append(suggestions, dir.name)
+		}
+		for _, file := range largestFiles(files) {
+			suggestions = append(suggestions, file.name)
+		}
+
+		cmd.PrintMessageAndQuit(fmt.Sprintf("The upload is %v, which is over the %v limit set by '--max-size'. If some of it doesn't need to be deployed, add it to %v. The largest offenders are:\n\n%v%v",
+			humanSize(total), humanSize(maxSize), ignoreFileName, cmd.LINE_PADDING, strings.Join(suggestions, "\n"+cmd.LINE_PADDING)))
+	}
+}
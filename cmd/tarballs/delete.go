@@ -0,0 +1,61 @@
+package tarballs
+
+import (
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/spf13/cobra"
+	"path"
+	"strings"
+)
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Deletes a tarball from your server.",
+	Long: `'delete' removes the tarball <name> (which can be a tag), along with its signature, tags and labels. If it was
+the '` + latestTag + `' tarball, '` + latestTag + `' moves to the most recent upload that's left.`,
+	Args: cobra.ExactArgs(1),
+	Run:  deleteTarball,
+}
+
+func init() {
+	rootTarballsCmd.AddCommand(deleteCmd)
+	cmd.Flags.Delete.Port = deleteCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.Delete.Host = deleteCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.Delete.Key = deleteCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	deleteCmd.MarkFlagRequired("host")
+}
+
+func deleteTarball(command *cobra.Command, args []string) {
+	client := connect(*cmd.Flags.Delete.Host, *cmd.Flags.Delete.Port, *cmd.Flags.Delete.Key)
+	defer client.Close()
+
+	name, remotePath := resolveTarball(client, args[0])
+
+	cmd.SSHCommand(client, fmt.Sprintf("rm -f %v %v", shellQuote(remotePath), shellQuote(remotePath+".sig")))
+
+	metadata := readMetadata(client)
+	removedTags := metadata.tagsFor(name)
+	for _, tag := range removedTags {
+		delete(metadata.Tags, tag)
+	}
+	delete(metadata.Labels, name)
+
+	moved := ""
+	if _, hadLatest := metadata.Tags[latestTag]; !hadLatest {
+		out, err := client.Exec(fmt.Sprintf("find %v -maxdepth 1 -type f -name '*.tar.gz*' ! -name '*.sig' -printf '%%T@\\t%%f\\n' | sort -n | tail -n 1 | cut -f 2", remoteTarballsDir))
+		cmd.AssertNoErr(err, fmt.Sprintf("Could not list %v.", remoteTarballsDir))
+		if newest := strings.TrimSpace(string(out)); newest != "" {
+			metadata.Tags[latestTag] = newest
+			moved = newest
+		}
+	}
+	writeMetadata(client, metadata)
+
+	cmd.PrintSubStepInformation(fmt.Sprintf("Deleted %v.", path.Join(remoteTarballsDir, name)))
+	if len(removedTags) > 0 {
+		cmd.PrintSubStepInformation(fmt.Sprintf("Removed its tags: %v.", strings.Join(removedTags, ", ")))
+	}
+	if moved != "" {
+		cmd.PrintSubStepInformation(fmt.Sprintf("Moved '%v' to '%v'.", latestTag, moved))
+	}
+}
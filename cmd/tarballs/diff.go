@@ -0,0 +1,132 @@
+package tarballs
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/spf13/cobra"
+	"path"
+	"sort"
+	"strings"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <a> <b>",
+	Short: "Shows what changed between two tarballs on your server.",
+	Long: `'diff' compares two tarballs that you've uploaded. It lists the files that were added, removed and modified
+going from <a> to <b>. Modified text files get a unified diff, and modified binary files show how much their size changed.
+
+Only the file hashes stored inside each tarball are sent over the network to figure out what changed, so big files
+that didn't change are never transferred.`,
+	Args: cobra.ExactArgs(2),
+	Run:  diff,
+}
+
+func init() {
+	rootTarballsCmd.AddCommand(diffCmd)
+	cmd.Flags.Diff.Port = diffCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.Diff.Host = diffCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.Diff.Key = diffCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	diffCmd.MarkFlagRequired("host")
+}
+
+func diff(command *cobra.Command, args []string) {
+	client := connect(*cmd.Flags.Diff.Host, *cmd.Flags.Diff.Port, *cmd.Flags.Diff.Key)
+	defer client.Close()
+
+	nameA, pathA := resolveTarball(client, args[0])
+	nameB, pathB := resolveTarball(client, args[1])
+
+	a := readRemoteManifest(client, nameA, pathA)
+	b := readRemoteManifest(client, nameB, pathB)
+
+	var added, removed, modified []string
+	for name, entryB := range b.Files {
+		entryA, ok := a.Files[name]
+		if !ok {
+			added = append(added, name)
+			continue
+		}
+		if entryA != entryB {
+			modified = append(modified, name)
+		}
+	}
+	for name := range a.Files {
+		if _, ok := b.Files[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(modified)
+
+	if len(added) == 0 && len(removed) == 0 && len(modified) == 0 {
+		cmd.PrintSubStepInformation(fmt.Sprintf("'%v' and '%v' have the same contents.", nameA, nameB))
+		return
+	}
+
+	for _, name := range added {
+		color.Green("+ %v (%v)", name, humanSize(b.Files[name].Size))
+	}
+	for _, name := range removed {
+		color.Red("- %v (%v)", name, humanSize(a.Files[name].Size))
+	}
+
+	var textFiles []string
+	for _, name := range modified {
+		entryA, entryB := a.Files[name], b.Files[name]
+
+		var details []string
+		if entryA.Mode != entryB.Mode {
+			details = append(details, fmt.Sprintf("mode %o -> %o", entryA.Mode, entryB.Mode))
+		}
+
+		if entryA.Sha256 != entryB.Sha256 {
+			if entryA.Binary || entryB.Binary {
+				details = append(details, fmt.Sprintf("binary, %v -> %v, %v", humanSize(entryA.Size), humanSize(entryB.Size), signedHumanSize(entryB.Size-entryA.Size)))
+			} else {
+				textFiles = append(textFiles, name)
+			}
+		}
+
+		if len(details) == 0 {
+			color.Yellow("~ %v", name)
+		} else {
+			color.Yellow("~ %v (%v)", name, strings.Join(details, ", "))
+		}
+	}
+
+	if len(textFiles) == 0 {
+		return
+	}
+
+	fmt.Println()
+	cmd.PrintSubStepInformation("Unified diff of modified text files:")
+
+	out, err := client.Exec("mktemp -d")
+	cmd.AssertNoErr(err, "Could not create temp directory.")
+	tempDir := strings.TrimSpace(string(out))
+	defer client.Exec(fmt.Sprintf("rm -rf %v", shellQuote(tempDir)))
+
+	quotedFiles := make([]string, len(textFiles))
+	for i, name := range textFiles {
+		quotedFiles[i] = shellQuote(name)
+	}
+
+	// Only the modified text files get pulled out of each tarball, and the actual diffing happens on the server.
+	for _, side := range []struct{ dir, tarball string }{{"a", pathA}, {"b", pathB}} {
+		sideDir := path.Join(tempDir, side.dir)
+		cmd.SSHCommand(client, fmt.Sprintf("mkdir -p %v && %v -C %v -- %v", shellQuote(sideDir), remoteTarReader(side.tarball), shellQuote(sideDir), strings.Join(quotedFiles, " ")))
+	}
+
+	// diff exits with 1 when the files are different, which is exactly what we expect here. Only 2 means trouble.
+	cmd.SSHCommand(client, fmt.Sprintf("cd %v && diff -ru a b; [ $? -le 1 ]", shellQuote(tempDir)))
+}
+
+func signedHumanSize(bytes int64) string {
+	if bytes >= 0 {
+		return "+" + humanSize(bytes)
+	}
+	return humanSize(bytes)
+}
@@ -0,0 +1,65 @@
+package tarballs
+
+import (
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/spf13/cobra"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+var downloadCmd = &cobra.Command{
+	Use:   "download <name>",
+	Short: "Downloads a tarball from your server.",
+	Long: `'download' copies the tarball <name> (which can be a tag) into the current directory, or into '--output', along
+with its signature if it has one. The file keeps its real name, so 'snakeplant tarballs download latest' saves
+something like 'myapp-1700000000-3f2a1c.tar.gz'.`,
+	Args: cobra.ExactArgs(1),
+	Run:  download,
+}
+
+func init() {
+	rootTarballsCmd.AddCommand(downloadCmd)
+	cmd.Flags.Download.Port = downloadCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.Download.Host = downloadCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.Download.Key = downloadCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	cmd.Flags.Download.Output = downloadCmd.Flags().StringP("output", "", ".", "The directory to save the tarball in.")
+	downloadCmd.MarkFlagRequired("host")
+}
+
+func download(command *cobra.Command, args []string) {
+	client := connect(*cmd.Flags.Download.Host, *cmd.Flags.Download.Port, *cmd.Flags.Download.Key)
+	defer client.Close()
+
+	name, remotePath := resolveTarball(client, args[0])
+
+	remoteFiles := []string{remotePath}
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", shellQuote(remotePath+".sig")))
+	cmd.AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking if the tarball is signed.")
+	if err == nil {
+		remoteFiles = append(remoteFiles, remotePath+".sig")
+	}
+
+	err = os.MkdirAll(*cmd.Flags.Download.Output, 0755)
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not create %v.", *cmd.Flags.Download.Output))
+
+	// scp for the same reason as upload, client.Download is too slow for big tarballs.
+	scpArgs := []string{"-P", strconv.Itoa(*cmd.Flags.Download.Port)}
+	if *cmd.Flags.Download.Key != "" {
+		scpArgs = append(scpArgs, "-i", *cmd.Flags.Download.Key)
+	}
+	for _, remoteFile := range remoteFiles {
+		scpArgs = append(scpArgs, fmt.Sprintf("%v@%v:%v", "root", *cmd.Flags.Download.Host, remoteFile))
+	}
+	scpArgs = append(scpArgs, *cmd.Flags.Download.Output)
+
+	output, err := exec.Command("scp", scpArgs...).CombinedOutput()
+	if err != nil {
+		fmt.Printf("%v: %v\n", string(output), err)
+		os.Exit(1)
+	}
+
+	cmd.PrintSubStepInformation(fmt.Sprintf("Saved %v.", filepath.Join(*cmd.Flags.Download.Output, name)))
+}
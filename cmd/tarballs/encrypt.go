@@ -0,0 +1,80 @@
+package tarballs
+
+import (
+	"filippo.io/age"
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+	"time"
+)
+
+// The deployment key never leaves the server after it's created. It's in the same format that 'age-keygen' writes, so
+// you can decrypt a tarball by hand with 'age -d -i /var/local/snakeplant/deployment-key <tarball>'.
+const deploymentKeyPath = "/var/local/snakeplant/deployment-key"
+const deploymentRecipientPath = deploymentKeyPath + ".pub"
+
+const encryptedSuffix = ".age"
+
+func isEncrypted(remotePath string) bool {
+	return strings.HasSuffix(remotePath, encryptedSuffix)
+}
+
+// Returns the start of a 'tar' command that reads the tarball at remotePath. The caller tacks on the rest of the
+// arguments. Encrypted tarballs are decrypted in a pipe, so the plain tarball is never written to disk.
+func remoteTarReader(remotePath string) string {
+	if isEncrypted(remotePath) {
+		return fmt.Sprintf("age -d -i %v %v | tar -xz -f -", deploymentKeyPath, shellQuote(remotePath))
+	}
+	return fmt.Sprintf("tar -xz -f %v", shellQuote(remotePath))
+}
+
+func encryptionRecipients(client *simplessh.Client, extraRecipients []string) []age.Recipient {
+	recipients := []age.Recipient{deploymentRecipient(client)}
+
+	// Extra recipients are for things like an offline backup key, so a tarball can still be recovered if the server is lost.
+	for _, r := range extraRecipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		cmd.AssertNoErr(err, fmt.Sprintf("'%v' is not a valid age recipient.", r))
+		recipients = append(recipients, recipient)
+	}
+	return recipients
+}
+
+func deploymentRecipient(client *simplessh.Client) age.Recipient {
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ] && [ -f %v ]", deploymentKeyPath, deploymentRecipientPath))
+	cmd.AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for the deployment key.")
+
+	if err != nil {
+		createDeploymentKey(client)
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", deploymentRecipientPath))
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not read %v.", deploymentRecipientPath))
+
+	recipient, err := age.ParseX25519Recipient(strings.TrimSpace(string(out)))
+	cmd.AssertNoErr(err, fmt.Sprintf("%v is corrupt.", deploymentRecipientPath))
+	return recipient
+}
+
+func createDeploymentKey(client *simplessh.Client) {
+	// If the private key exists but the public one doesn't, something went wrong half way through last time. We can't
+	// just make a new key, because every tarball encrypted with the old one would become unreadable.
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", deploymentKeyPath))
+	cmd.AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for the deployment key.")
+	if err == nil {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("%v exists but %v doesn't. Recreate it with 'age-keygen -y %v > %v'.", deploymentKeyPath, deploymentRecipientPath, deploymentKeyPath, deploymentRecipientPath))
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	cmd.AssertNoErr(err, "Could not generate deployment key.")
+
+	_, err = client.Exec("mkdir -p /var/local/snakeplant")
+	cmd.AssertNoErr(err, "Unable to create /var/local/snakeplant.")
+
+	keyFile := fmt.Sprintf("# created: %v\n# public key: %v\n%v\n", time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+	cmd.WriteRemoteFile(client, deploymentKeyPath, []byte(keyFile), 0600)
+	cmd.WriteRemoteFile(client, deploymentRecipientPath, []byte(identity.Recipient().String()+"\n"), 0644)
+
+	fmt.Printf("created deployment key at %v\n", deploymentKeyPath)
+}
@@ -0,0 +1,61 @@
+package tarballs
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Lives at the root of the directory being uploaded. One pattern per line, '#' starts a comment.
+//
+// A pattern without a '/' (like '*.mp4') is matched against every file and directory name. A pattern with a '/'
+// (like 'fixtures/videos') is matched against the path from the root. Either way, if it matches a directory,
+// everything under that directory is skipped.
+const ignoreFileName = ".snakeplantignore"
+
+type ignoreRules struct {
+	patterns []string
+}
+
+func loadIgnoreRules(wd string) ignoreRules {
+	file, err := os.Open(filepath.Join(wd, ignoreFileName))
+	if os.IsNotExist(err) {
+		return ignoreRules{}
+	}
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not open %v.", ignoreFileName))
+	defer file.Close()
+
+	var rules ignoreRules
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules.patterns = append(rules.patterns, strings.Trim(filepath.ToSlash(line), "/"))
+	}
+	cmd.AssertNoErr(scanner.Err(), fmt.Sprintf("Could not read %v.", ignoreFileName))
+	return rules
+}
+
+// name is the slash separated path relative to the root of the upload.
+func (r ignoreRules) ignored(name string) bool {
+	for _, pattern := range r.patterns {
+		if strings.Contains(pattern, "/") {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+			continue
+		}
+
+		for _, part := range strings.Split(name, "/") {
+			if matched, _ := filepath.Match(pattern, part); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
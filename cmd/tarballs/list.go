@@ -2,28 +2,81 @@ package tarballs
 
 import (
 	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
 	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "Lists all the tarballs that you've uploaded to your server.",
-	Long:  `So cool`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("list called")
-	},
+	Long: `'list' shows every tarball in /var/local/snakeplant/tarballs, oldest first, along with its size,
+when it was uploaded, whether it's signed or encrypted, and any tags or labels it has.`,
+	Args: cobra.NoArgs,
+	Run:  list,
 }
 
 func init() {
 	rootTarballsCmd.AddCommand(listCmd)
+	cmd.Flags.List.Port = listCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.List.Host = listCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.List.Key = listCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	listCmd.MarkFlagRequired("host")
+}
+
+func list(command *cobra.Command, args []string) {
+	client := connect(*cmd.Flags.List.Host, *cmd.Flags.List.Port, *cmd.Flags.List.Key)
+	defer client.Close()
+
+	out, err := client.Exec(fmt.Sprintf("mkdir -p %v && find %v -maxdepth 1 -type f -name '*.tar.gz*' ! -name '*.sig' -printf '%%T@\\t%%s\\t%%f\\n' | sort -n", remoteTarballsDir, remoteTarballsDir))
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not list %v.", remoteTarballsDir))
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		cmd.PrintSubStepInformation("There are no tarballs on your server. Upload one with 'snakeplant tarballs upload'.")
+		return
+	}
 
-	// Here you will define your flags and configuration settings.
+	out, err = client.Exec(fmt.Sprintf("find %v -maxdepth 1 -type f -name '*.sig' -printf '%%f\\n'", remoteTarballsDir))
+	cmd.AssertNoErr(err, "Could not list tarball signatures.")
+	signed := map[string]bool{}
+	for _, sig := range strings.Split(string(out), "\n") {
+		signed[strings.TrimSuffix(sig, ".sig")] = true
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// listCmd.PersistentFlags().String("foo", "", "A help for foo")
+	metadata := readMetadata(client)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tSIZE\tUPLOADED\tSIGNED\tENCRYPTED\tTAGS\tLABELS")
+	for _, line := range lines {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		seconds, _ := strconv.ParseFloat(fields[0], 64)
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		name := fields[2]
+
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			name,
+			humanSize(size),
+			time.Unix(int64(seconds), 0).Format("2006-01-02 15:04"),
+			yesNo(signed[name]),
+			yesNo(isEncrypted(name)),
+			strings.Join(metadata.tagsFor(name), ","),
+			formatLabels(metadata.Labels[name]))
+	}
+	writer.Flush()
+}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// listCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
 }
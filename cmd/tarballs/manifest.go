@@ -0,0 +1,59 @@
+package tarballs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/sfreiberg/simplessh"
+)
+
+// The manifest is written as the last entry of every tarball. It lets us answer questions about a tarball
+// (like what changed between two of them) by pulling a few KB over the network instead of the whole thing.
+const manifestName = ".snakeplant-manifest.json"
+
+type manifestEntry struct {
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	Mode   int64  `json:"mode"`
+	Binary bool   `json:"binary"`
+}
+
+type manifest struct {
+	Files map[string]manifestEntry `json:"files"`
+}
+
+// Same heuristic as git and diff use: if there's a NUL byte somewhere near the start, it's binary.
+const binarySniffLength = 8000
+
+type binarySniffer struct {
+	seen   int
+	binary bool
+}
+
+func (b *binarySniffer) Write(p []byte) (n int, err error) {
+	if b.seen < binarySniffLength {
+		end := len(p)
+		if end > binarySniffLength-b.seen {
+			end = binarySniffLength - b.seen
+		}
+		if bytes.IndexByte(p[:end], 0) != -1 {
+			b.binary = true
+		}
+		b.seen += end
+	}
+	return len(p), nil
+}
+
+func readRemoteManifest(client *simplessh.Client, name, remotePath string) manifest {
+	// Decompressing the whole tarball happens on the server, so only the manifest comes back over the wire.
+	out, err := client.Exec(fmt.Sprintf("%v -O %v", remoteTarReader(remotePath), manifestName))
+	if err != nil {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' doesn't have a manifest. It was probably uploaded by an older version of snakeplant.", name))
+	}
+
+	var m manifest
+	err = json.Unmarshal(out, &m)
+	cmd.AssertNoErr(err, fmt.Sprintf("The manifest in '%v' is corrupt.", name))
+	return m
+}
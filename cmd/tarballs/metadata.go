@@ -0,0 +1,91 @@
+package tarballs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/sfreiberg/simplessh"
+	"sort"
+	"strings"
+)
+
+const metadataPath = "/var/local/snakeplant/tarballs.json"
+
+// Moved to every new upload automatically, so there's always an easy way to refer to the most recent one.
+const latestTag = "latest"
+
+// Tags point at exactly one tarball, so giving a tag to a tarball moves it off of whatever had it before.
+// Labels are free-form key/value pairs that just get shown by 'list'.
+type tarballMetadata struct {
+	Tags   map[string]string            `json:"tags"`
+	Labels map[string]map[string]string `json:"labels"`
+}
+
+func readMetadata(client *simplessh.Client) tarballMetadata {
+	m := tarballMetadata{Tags: map[string]string{}, Labels: map[string]map[string]string{}}
+
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", metadataPath))
+	cmd.AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for tarball metadata.")
+	if err != nil {
+		return m
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", metadataPath))
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not read %v.", metadataPath))
+
+	err = json.Unmarshal(out, &m)
+	cmd.AssertNoErr(err, fmt.Sprintf("%v is corrupt.", metadataPath))
+
+	if m.Tags == nil {
+		m.Tags = map[string]string{}
+	}
+	if m.Labels == nil {
+		m.Labels = map[string]map[string]string{}
+	}
+	return m
+}
+
+func writeMetadata(client *simplessh.Client, m tarballMetadata) {
+	content, err := json.MarshalIndent(m, "", "  ")
+	cmd.AssertNoErr(err, "Could not serialize tarball metadata.")
+
+	cmd.WriteRemoteFile(client, metadataPath, append(content, '\n'), 0644)
+}
+
+func (m tarballMetadata) tagsFor(name string) []string {
+	var tags []string
+	for tag, tarball := range m.Tags {
+		if tarball == name {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func validateTag(tag string) {
+	if tag == "" || strings.ContainsAny(tag, "/ \t\n") || strings.Contains(tag, ".tar.gz") {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' is not a valid tag. Tags can't be empty, contain '/' or whitespace, or look like a tarball name.", tag))
+	}
+}
+
+func parseLabels(labels []string) map[string]string {
+	parsed := map[string]string{}
+	for _, label := range labels {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' is not a valid label. Labels look like 'env=staging'.", label))
+		}
+		parsed[key] = value
+	}
+	return parsed
+}
+
+func formatLabels(labels map[string]string) string {
+	var formatted []string
+	for key, value := range labels {
+		formatted = append(formatted, fmt.Sprintf("%v=%v", key, value))
+	}
+	sort.Strings(formatted)
+	return strings.Join(formatted, ",")
+}
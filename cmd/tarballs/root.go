@@ -1,11 +1,19 @@
 package tarballs
 
 import (
+	"fmt"
 	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/sfreiberg/simplessh"
 	"github.com/spf13/cobra"
 	"os"
+	"path"
+	"strings"
+	"time"
 )
 
+// Don't want to use filepath for anything under here because it's a path on the remote server.
+const remoteTarballsDir = "/var/local/snakeplant/tarballs"
+
 var rootTarballsCmd = &cobra.Command{
 	Use:   "tarballs",
 	Short: "Allows you to interact with the source releases (\"tarballs\") on your server.",
@@ -24,3 +32,63 @@ to quickly create a Cobra application.`,
 func init() {
 	cmd.RootCmd.AddCommand(rootTarballsCmd)
 }
+
+func connect(host string, port int, key string) *simplessh.Client {
+	socket := fmt.Sprintf("%v:%v", host, port)
+
+	client, err := simplessh.ConnectWithKeyFileTimeout(socket, "root", key, 5*time.Second)
+	cmd.AssertNoErr(err, "Unable to establish a connection.")
+	return client
+}
+
+// Anywhere a tarball name is expected, a tag works too. Returns the real tarball name and where it lives on the server.
+//
+// Tarball names come straight from the command line, so make sure nobody can walk out of the tarballs directory.
+func resolveTarball(client *simplessh.Client, nameOrTag string) (string, string) {
+	if nameOrTag == "" || strings.Contains(nameOrTag, "/") || nameOrTag == "." || nameOrTag == ".." {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' is not a valid tarball name.", nameOrTag))
+	}
+
+	name := nameOrTag
+	if tagged, ok := readMetadata(client).Tags[nameOrTag]; ok && !remoteTarballExists(client, nameOrTag) {
+		name = tagged
+	}
+
+	if !remoteTarballExists(client, name) {
+		if name != nameOrTag {
+			cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' is tagged '%v', but it doesn't exist on your server anymore.", name, nameOrTag))
+		}
+		cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' does not exist on your server. Run 'snakeplant tarballs list' to see what's there.", name))
+	}
+	return name, path.Join(remoteTarballsDir, name)
+}
+
+func remoteTarballExists(client *simplessh.Client, name string) bool {
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", shellQuote(path.Join(remoteTarballsDir, name))))
+	cmd.AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking if the tarball exists.")
+	return err == nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func humanSize(bytes int64) string {
+	sign := ""
+	if bytes < 0 {
+		sign = "-"
+		bytes = -bytes
+	}
+
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%v%v B", sign, bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%v%.1f %ciB", sign, float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,157 @@
+package tarballs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"strings"
+)
+
+const trustedKeysPath = "/var/local/snakeplant/trusted-keys"
+
+// Used when '--signing-key' isn't passed, mostly so CI doesn't need to change how it calls 'upload'.
+const signingKeyEnvVar = "SNAKEPLANT_SIGNING_KEY"
+
+// Prefixing the digest means a signature made for a tarball can't be replayed as a signature for anything else
+// that happens to be signed with the same key.
+const signaturePrefix = "snakeplant-tarball-sha256:"
+
+type tarballSignature struct {
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <name>",
+	Short: "Checks that a tarball on your server was signed by a trusted signer.",
+	Long: `'verify' checks the signature stored next to a tarball against the trusted signers on your server.
+It fails if the tarball is unsigned, was changed after it was signed, or was signed by a key that isn't trusted
+(or was revoked). See 'snakeplant tarballs signers' for managing who is trusted.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(command *cobra.Command, args []string) {
+		client := connect(*cmd.Flags.Verify.Host, *cmd.Flags.Verify.Port, *cmd.Flags.Verify.Key)
+		defer client.Close()
+
+		name, remotePath := resolveTarball(client, args[0])
+		signer := verifyTarball(client, name, remotePath)
+		cmd.PrintSubStepInformation(fmt.Sprintf("'%v' was signed by '%v'.", name, signer))
+	},
+}
+
+func init() {
+	rootTarballsCmd.AddCommand(verifyCmd)
+	cmd.Flags.Verify.Port = verifyCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.Verify.Host = verifyCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.Verify.Key = verifyCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	verifyCmd.MarkFlagRequired("host")
+}
+
+func signingKeyPath() string {
+	if *cmd.Flags.Upload.SigningKey != "" {
+		return *cmd.Flags.Upload.SigningKey
+	}
+	return os.Getenv(signingKeyEnvVar)
+}
+
+func loadSigner(keyPath string) ssh.Signer {
+	pemBytes, err := os.ReadFile(keyPath)
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not read signing key '%v'.", keyPath))
+
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		cmd.PrintMessageAndQuit("Signing keys with a passphrase aren't supported. Create a dedicated key for signing with 'ssh-keygen -t ed25519 -N \"\"'.")
+	}
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not parse signing key '%v'.", keyPath))
+
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("Signing keys must be ed25519, but '%v' is %v. Create one with 'ssh-keygen -t ed25519'.", keyPath, signer.PublicKey().Type()))
+	}
+	return signer
+}
+
+func localFileDigest(filePath string) string {
+	file, err := os.Open(filePath)
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not open '%v' to hash it.", filePath))
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not hash '%v'.", filePath))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Returns the path of the signature file, which is meant to be uploaded right alongside the tarball.
+func signTarball(tarballPath string, signer ssh.Signer) string {
+	digest := localFileDigest(tarballPath)
+
+	signature, err := signer.Sign(rand.Reader, []byte(signaturePrefix+digest))
+	cmd.AssertNoErr(err, "Could not sign tarball.")
+
+	signatureBytes, err := json.MarshalIndent(tarballSignature{
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(signature)),
+	}, "", "  ")
+	cmd.AssertNoErr(err, "Could not serialize tarball signature.")
+
+	signaturePath := tarballPath + ".sig"
+	err = os.WriteFile(signaturePath, signatureBytes, 0644)
+	cmd.AssertNoErr(err, "Could not write tarball signature.")
+	return signaturePath
+}
+
+// The digest is computed on the server, so we're checking the bytes that will actually get deployed, not whatever
+// we happen to have locally. Returns the name of the signer. Anything that deploys a tarball needs to call this first.
+func verifyTarball(client *simplessh.Client, name, remotePath string) string {
+	trusted := readTrustedKeys(client)
+	if len(trusted) == 0 {
+		cmd.PrintMessageAndQuit("There are no trusted signers on your server. Add one with 'snakeplant tarballs signers add'.")
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", shellQuote(remotePath+".sig")))
+	if err != nil {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' is not signed.", name))
+	}
+
+	var sig tarballSignature
+	err = json.Unmarshal(out, &sig)
+	cmd.AssertNoErr(err, fmt.Sprintf("The signature for '%v' is corrupt.", name))
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sig.PublicKey))
+	cmd.AssertNoErr(err, fmt.Sprintf("The signature for '%v' has a corrupt public key.", name))
+
+	var signerName string
+	for _, key := range trusted {
+		if ssh.FingerprintSHA256(key.publicKey) == ssh.FingerprintSHA256(publicKey) {
+			signerName = key.name
+		}
+	}
+	if signerName == "" {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("'%v' was signed by %v, which is not a trusted signer.", name, ssh.FingerprintSHA256(publicKey)))
+	}
+
+	signatureBlob, err := base64.StdEncoding.DecodeString(sig.Signature)
+	cmd.AssertNoErr(err, fmt.Sprintf("The signature for '%v' is corrupt.", name))
+
+	var signature ssh.Signature
+	err = ssh.Unmarshal(signatureBlob, &signature)
+	cmd.AssertNoErr(err, fmt.Sprintf("The signature for '%v' is corrupt.", name))
+
+	out, err = client.Exec(fmt.Sprintf("sha256sum %v | awk '{print $1}'", shellQuote(remotePath)))
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not get hash of '%v'.", name))
+	digest := strings.TrimSpace(string(out))
+
+	err = publicKey.Verify([]byte(signaturePrefix+digest), &signature)
+	if err != nil {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("The signature for '%v' does not match its contents. It was changed after it was signed.", name))
+	}
+	return signerName
+}
@@ -0,0 +1,170 @@
+package tarballs
+
+import (
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/sfreiberg/simplessh"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+)
+
+type trustedKey struct {
+	name      string
+	publicKey ssh.PublicKey
+}
+
+var signersCmd = &cobra.Command{
+	Use:   "signers",
+	Short: "Manages the keys that are trusted to sign tarballs.",
+	Long: `The trusted signers live in /var/local/snakeplant/trusted-keys on your server. It's in the same format as an
+'authorized_keys' file, so you can read it (or fix it by hand) if something goes wrong.
+
+Signing keys are plain ed25519 ssh keys. You can make one for yourself or for CI with:
+
+    ssh-keygen -t ed25519 -N "" -f ~/.ssh/snakeplant_signing
+
+and then pass '--signing-key ~/.ssh/snakeplant_signing' to 'snakeplant tarballs upload'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+		os.Exit(0)
+	},
+}
+
+var signersAddCmd = &cobra.Command{
+	Use:   "add <name> <public-key-file>",
+	Short: "Trusts a new signer.",
+	Long:  `'add' trusts the ed25519 public key in <public-key-file> (like ~/.ssh/snakeplant_signing.pub) under <name>.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   signersAdd,
+}
+
+var signersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the trusted signers.",
+	Long:  `'list' shows the name and fingerprint of every trusted signer.`,
+	Args:  cobra.NoArgs,
+	Run:   signersList,
+}
+
+var signersRevokeCmd = &cobra.Command{
+	Use:   "revoke <name>",
+	Short: "Stops trusting a signer.",
+	Long:  `'revoke' removes a signer. Tarballs that it signed will no longer pass verification.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   signersRevoke,
+}
+
+func init() {
+	rootTarballsCmd.AddCommand(signersCmd)
+	signersCmd.AddCommand(signersAddCmd)
+	signersCmd.AddCommand(signersListCmd)
+	signersCmd.AddCommand(signersRevokeCmd)
+	cmd.Flags.Signers.Port = signersCmd.PersistentFlags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.Signers.Host = signersCmd.PersistentFlags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.Signers.Key = signersCmd.PersistentFlags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	signersCmd.MarkPersistentFlagRequired("host")
+}
+
+func signersAdd(command *cobra.Command, args []string) {
+	name, keyPath := args[0], args[1]
+	if strings.ContainsAny(name, " \t\n") {
+		cmd.PrintMessageAndQuit("Signer names can't contain whitespace.")
+	}
+
+	keyBytes, err := os.ReadFile(keyPath)
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not read public key '%v'.", keyPath))
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not parse public key '%v'. Make sure you passed the '.pub' file.", keyPath))
+
+	if publicKey.Type() != ssh.KeyAlgoED25519 {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("Signing keys must be ed25519, but '%v' is %v.", keyPath, publicKey.Type()))
+	}
+
+	client := connect(*cmd.Flags.Signers.Host, *cmd.Flags.Signers.Port, *cmd.Flags.Signers.Key)
+	defer client.Close()
+
+	trusted := readTrustedKeys(client)
+	for _, key := range trusted {
+		if key.name == name {
+			cmd.PrintMessageAndQuit(fmt.Sprintf("There is already a signer named '%v'. Revoke it first if you want to replace it.", name))
+		}
+		if ssh.FingerprintSHA256(key.publicKey) == ssh.FingerprintSHA256(publicKey) {
+			cmd.PrintMessageAndQuit(fmt.Sprintf("That key is already trusted as '%v'.", key.name))
+		}
+	}
+
+	writeTrustedKeys(client, append(trusted, trustedKey{name: name, publicKey: publicKey}))
+	cmd.PrintSubStepInformation(fmt.Sprintf("'%v' (%v) is now a trusted signer.", name, ssh.FingerprintSHA256(publicKey)))
+}
+
+func signersList(command *cobra.Command, args []string) {
+	client := connect(*cmd.Flags.Signers.Host, *cmd.Flags.Signers.Port, *cmd.Flags.Signers.Key)
+	defer client.Close()
+
+	trusted := readTrustedKeys(client)
+	if len(trusted) == 0 {
+		cmd.PrintSubStepInformation("There are no trusted signers.")
+		return
+	}
+
+	for _, key := range trusted {
+		fmt.Printf("%v  %v\n", ssh.FingerprintSHA256(key.publicKey), key.name)
+	}
+}
+
+func signersRevoke(command *cobra.Command, args []string) {
+	client := connect(*cmd.Flags.Signers.Host, *cmd.Flags.Signers.Port, *cmd.Flags.Signers.Key)
+	defer client.Close()
+
+	trusted := readTrustedKeys(client)
+	remaining := make([]trustedKey, 0, len(trusted))
+	for _, key := range trusted {
+		if key.name != args[0] {
+			remaining = append(remaining, key)
+		}
+	}
+
+	if len(remaining) == len(trusted) {
+		cmd.PrintMessageAndQuit(fmt.Sprintf("There is no signer named '%v'.", args[0]))
+	}
+
+	writeTrustedKeys(client, remaining)
+	cmd.PrintSubStepInformation(fmt.Sprintf("'%v' is no longer a trusted signer.", args[0]))
+}
+
+func readTrustedKeys(client *simplessh.Client) []trustedKey {
+	_, err := client.Exec(fmt.Sprintf("[ -f %v ]", trustedKeysPath))
+	cmd.AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for trusted keys.")
+	if err != nil {
+		return nil
+	}
+
+	out, err := client.Exec(fmt.Sprintf("cat %v", trustedKeysPath))
+	cmd.AssertNoErr(err, fmt.Sprintf("Could not read %v.", trustedKeysPath))
+
+	var keys []trustedKey
+	rest := out
+	for len(strings.TrimSpace(string(rest))) > 0 {
+		var publicKey ssh.PublicKey
+		var comment string
+		publicKey, comment, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		cmd.AssertNoErr(err, fmt.Sprintf("%v is corrupt.", trustedKeysPath))
+		keys = append(keys, trustedKey{name: comment, publicKey: publicKey})
+	}
+	return keys
+}
+
+func writeTrustedKeys(client *simplessh.Client, keys []trustedKey) {
+	var content strings.Builder
+	for _, key := range keys {
+		content.WriteString(fmt.Sprintf("%v %v\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.publicKey))), key.name))
+	}
+
+	_, err := client.Exec("mkdir -p /var/local/snakeplant")
+	cmd.AssertNoErr(err, "Unable to create /var/local/snakeplant.")
+
+	cmd.WriteRemoteFile(client, trustedKeysPath, []byte(content.String()), 0600)
+}
@@ -0,0 +1,46 @@
+package tarballs
+
+import (
+	"fmt"
+	"github.com/mavenraven/snakeplant/cmd"
+	"github.com/spf13/cobra"
+)
+
+var tagCmd = &cobra.Command{
+	Use:   "tag <name> <tag>",
+	Short: "Gives a tarball a tag that can be used instead of its name.",
+	Long: `'tag' points <tag> at the tarball <name> (which can itself be a tag). A tag only ever points at one tarball,
+so if another tarball already had <tag>, it's moved. For example, 'snakeplant tarballs tag latest stable' marks
+the most recent upload as stable.`,
+	Args: cobra.ExactArgs(2),
+	Run:  tag,
+}
+
+func init() {
+	rootTarballsCmd.AddCommand(tagCmd)
+	cmd.Flags.Tag.Port = tagCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
+	cmd.Flags.Tag.Host = tagCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
+	cmd.Flags.Tag.Key = tagCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	tagCmd.MarkFlagRequired("host")
+}
+
+func tag(command *cobra.Command, args []string) {
+	newTag := args[1]
+	validateTag(newTag)
+
+	client := connect(*cmd.Flags.Tag.Host, *cmd.Flags.Tag.Port, *cmd.Flags.Tag.Key)
+	defer client.Close()
+
+	name, _ := resolveTarball(client, args[0])
+
+	metadata := readMetadata(client)
+	previous, hadTag := metadata.Tags[newTag]
+	metadata.Tags[newTag] = name
+	writeMetadata(client, metadata)
+
+	if hadTag && previous != name {
+		cmd.PrintSubStepInformation(fmt.Sprintf("Moved '%v' from '%v' to '%v'.", newTag, previous, name))
+	} else {
+		cmd.PrintSubStepInformation(fmt.Sprintf("Tagged '%v' as '%v'.", name, newTag))
+	}
+}
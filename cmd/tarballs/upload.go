@@ -3,12 +3,16 @@ package tarballs
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"filippo.io/age"
 	"fmt"
+	"github.com/fatih/color"
 	"github.com/mavenraven/snakeplant/cmd"
-	"github.com/sfreiberg/simplessh"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
 	"io"
-	"io/fs"
 	"os"
 	"os/exec"
 	"path"
@@ -29,35 +33,63 @@ func init() {
 	cmd.Flags.Upload.Port = uploadCmd.Flags().IntP("port", "", 22, "The port number of the ssh daemon running on your server.")
 	cmd.Flags.Upload.Host = uploadCmd.Flags().StringP("host", "", "", "The host name or IP address of your server.")
 	cmd.Flags.Upload.Key = uploadCmd.Flags().StringP("key", "", "", "The location of your 'id_rsa' file. Defaults to $HOME/.ssh/id_rsa.")
+	cmd.Flags.Upload.SigningKey = uploadCmd.Flags().StringP("signing-key", "", "", fmt.Sprintf("The location of an ed25519 private key to sign the tarball with. Defaults to $%v.", signingKeyEnvVar))
+	cmd.Flags.Upload.Encrypt = uploadCmd.Flags().BoolP("encrypt", "", false, "Encrypt the tarball so that it can only be read with the deployment key on your server.")
+	cmd.Flags.Upload.Recipients = uploadCmd.Flags().StringSliceP("recipient", "", []string{}, "An extra age public key (age1...) that can decrypt the tarball, like an offline backup key. Implies '--encrypt'.")
+	cmd.Flags.Upload.MaxSize = uploadCmd.Flags().StringP("max-size", "", "500MB", "Refuse to upload if all of the files add up to more than this, before compression. '0' means no limit.")
+	cmd.Flags.Upload.MaxFileSize = uploadCmd.Flags().StringP("max-file-size", "", "100MB", "Refuse to upload if any single file is bigger than this. '0' means no limit.")
+	cmd.Flags.Upload.Tags = uploadCmd.Flags().StringSliceP("tag", "", []string{}, fmt.Sprintf("A tag like 'v2.3.0' that can be used instead of the tarball's name. The '%v' tag is always added.", latestTag))
+	cmd.Flags.Upload.Labels = uploadCmd.Flags().StringSliceP("label", "", []string{}, "A 'key=value' label to attach to the tarball, like 'env=staging'.")
 	uploadCmd.MarkFlagRequired("host")
 }
 
 func upload(command *cobra.Command, args []string) {
-	tarballName := createTarball()
-	fmt.Println(tarballName)
+	for _, tag := range *cmd.Flags.Upload.Tags {
+		validateTag(tag)
+	}
+	labels := parseLabels(*cmd.Flags.Upload.Labels)
 
-	_, tarballFileName := path.Split(tarballName)
+	// Load the key up front so a bad key fails before we spend time building the tarball.
+	var signer ssh.Signer
+	if keyPath := signingKeyPath(); keyPath != "" {
+		signer = loadSigner(keyPath)
+	}
+
+	client := connect(*cmd.Flags.Upload.Host, *cmd.Flags.Upload.Port, *cmd.Flags.Upload.Key)
+	defer client.Close()
+
+	var recipients []age.Recipient
+	if *cmd.Flags.Upload.Encrypt || len(*cmd.Flags.Upload.Recipients) > 0 {
+		recipients = encryptionRecipients(client, *cmd.Flags.Upload.Recipients)
+	}
 
-	socket := fmt.Sprintf("%v:%v", *cmd.Flags.Upload.Host, *cmd.Flags.Upload.Port)
+	tarballName := createTarball(recipients)
+	fmt.Println(tarballName)
 
-	client, err := simplessh.ConnectWithKeyFileTimeout(socket, "root", *cmd.Flags.Upload.Key, 5*time.Second)
-	cmd.AssertNoErr(err, "Unable to establish a connection.")
+	filesToUpload := []string{tarballName}
+	if signer != nil {
+		filesToUpload = append(filesToUpload, signTarball(tarballName, signer))
+		fmt.Printf("tarball signed with %v\n", ssh.FingerprintSHA256(signer.PublicKey()))
+	} else {
+		color.Yellow("no signing key was given, so the tarball is unsigned and will fail 'snakeplant tarballs verify'")
+	}
 
-	remoteDir := "/var/local/snakeplant/tarballs"
-	_, err = client.Exec(fmt.Sprintf("mkdir -p %s", remoteDir))
-	cmd.AssertNoErr(err, fmt.Sprintf("Unable to create %v.", remoteDir))
+	_, tarballFileName := path.Split(tarballName)
 
-	// don't want to use filepath.Join because it's the remote serve path
-	remoteFileName := path.Join(remoteDir, tarballFileName)
+	_, err := client.Exec(fmt.Sprintf("mkdir -p %s", remoteTarballsDir))
+	cmd.AssertNoErr(err, fmt.Sprintf("Unable to create %v.", remoteTarballsDir))
+
+	remoteFileName := path.Join(remoteTarballsDir, tarballFileName)
 
 	fmt.Printf("uploading tarball to %v at %v...\n", remoteFileName, time.Now().Format("15:04:05"))
 
 	//client.Upload is unusably slow, just shell out instead for now.
 	scpArgs := make([]string, 0)
 	if *cmd.Flags.Upload.Key != "" {
-		args = append(args, "-i", *cmd.Flags.Upload.Key)
+		scpArgs = append(scpArgs, "-i", *cmd.Flags.Upload.Key)
 	}
-	scpArgs = append(args, tarballName, fmt.Sprintf("%v@%v:%v", "root", *cmd.Flags.Upload.Host, remoteFileName))
+	scpArgs = append(scpArgs, filesToUpload...)
+	scpArgs = append(scpArgs, fmt.Sprintf("%v@%v:%v/", "root", *cmd.Flags.Upload.Host, remoteTarballsDir))
 
 	scpCmd := exec.Command("scp", scpArgs...)
 	output, err := scpCmd.CombinedOutput()
@@ -67,9 +99,21 @@ func upload(command *cobra.Command, args []string) {
 	}
 	fmt.Printf("tarball uploaded at %v\n", time.Now().Format("15:04:05"))
 
+	// Only record tags and labels once the tarball is actually there, so a failed upload doesn't move 'latest'.
+	metadata := readMetadata(client)
+	for _, tag := range append(*cmd.Flags.Upload.Tags, latestTag) {
+		metadata.Tags[tag] = tarballFileName
+	}
+	if len(labels) > 0 {
+		metadata.Labels[tarballFileName] = labels
+	}
+	writeMetadata(client, metadata)
+	fmt.Printf("tagged as %v\n", strings.Join(metadata.tagsFor(tarballFileName), ", "))
+
 }
 
-func createTarball() string {
+// If there are any recipients, the tarball is encrypted to them after it's compressed.
+func createTarball(recipients []age.Recipient) string {
 	wd, err := os.Getwd()
 	cmd.AssertNoErr(err, "Could not get current working directory to walk tarball tree.")
 
@@ -83,51 +127,81 @@ func createTarball() string {
 		tarballName = fmt.Sprintf("%v-%v.tar.gz", folderName, time.Now().Unix())
 	}
 
+	if len(recipients) > 0 {
+		tarballName += encryptedSuffix
+	}
+
+	// Everything that could make us bail out happens before we start writing, so there's no half-built tarball left over.
+	files := collectFiles(wd)
+	printSizeReport(files)
+	checkSizeBudget(files)
+
 	tarballFile, err := os.Create(filepath.Join(os.TempDir(), tarballName))
 	cmd.AssertNoErr(err, "Unable to create tarball file.")
 
 	fmt.Printf("creating tarball of files to upload: %v...\n", tarballFile.Name())
 	defer tarballFile.Close()
 
-	gzipWriter := gzip.NewWriter(tarballFile)
+	var compressedWriter io.Writer = tarballFile
+	if len(recipients) > 0 {
+		encryptedWriter, err := age.Encrypt(tarballFile, recipients...)
+		cmd.AssertNoErr(err, "Unable to start encrypting tarball.")
+		defer encryptedWriter.Close()
+		compressedWriter = encryptedWriter
+	}
+
+	gzipWriter := gzip.NewWriter(compressedWriter)
 	defer gzipWriter.Close()
 
 	tarWriter := tar.NewWriter(gzipWriter)
 	defer tarWriter.Close()
 
-	filepath.Walk(wd, func(path string, info fs.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-
-		if strings.Contains(path, ".git") {
-			//TODO: we could use the gitignore to filter out other junk
-			return nil
-		}
-
-		cmd.AssertNoErr(err, fmt.Sprintf("Could not walk into %v.", path))
+	m := manifest{Files: map[string]manifestEntry{}}
 
-		fileToAdd, err := os.Open(path)
-		cmd.AssertNoErr(err, fmt.Sprintf("Could not open '%v' to add to tarball.", path))
-		defer fileToAdd.Close()
+	for _, file := range files {
+		fileToAdd, err := os.Open(file.path)
+		cmd.AssertNoErr(err, fmt.Sprintf("Could not open '%v' to add to tarball.", file.path))
 
 		stat, err := fileToAdd.Stat()
-		cmd.AssertNoErr(err, fmt.Sprintf("Could not get stat of '%v' to add to tarball", path))
+		cmd.AssertNoErr(err, fmt.Sprintf("Could not get stat of '%v' to add to tarball", file.path))
 
 		header := &tar.Header{
-			Name:    path[len(wd)+1:],
+			Name:    file.name,
 			Size:    stat.Size(),
 			Mode:    int64(stat.Mode()),
 			ModTime: stat.ModTime(),
 		}
 
 		err = tarWriter.WriteHeader(header)
-		cmd.AssertNoErr(err, fmt.Sprintf("Could not write header for '%v' in tarball", path))
+		cmd.AssertNoErr(err, fmt.Sprintf("Could not write header for '%v' in tarball", file.path))
+
+		hash := sha256.New()
+		sniffer := &binarySniffer{}
+		_, err = io.Copy(io.MultiWriter(tarWriter, hash, sniffer), fileToAdd)
+		cmd.AssertNoErr(err, fmt.Sprintf("Could not copy '%v' into tarball", file.path))
+
+		m.Files[file.name] = manifestEntry{
+			Sha256: hex.EncodeToString(hash.Sum(nil)),
+			Size:   stat.Size(),
+			Mode:   int64(stat.Mode()),
+			Binary: sniffer.binary,
+		}
+		fileToAdd.Close()
+	}
+
+	manifestBytes, err := json.MarshalIndent(m, "", "  ")
+	cmd.AssertNoErr(err, "Could not serialize tarball manifest.")
 
-		_, err = io.Copy(tarWriter, fileToAdd)
-		cmd.AssertNoErr(err, fmt.Sprintf("Could not copy '%v' into tarball", path))
-		return nil
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Size:    int64(len(manifestBytes)),
+		Mode:    0644,
+		ModTime: time.Now(),
 	})
+	cmd.AssertNoErr(err, "Could not write header for manifest in tarball.")
+
+	_, err = tarWriter.Write(manifestBytes)
+	cmd.AssertNoErr(err, "Could not write manifest into tarball.")
 
 	return tarballFile.Name()
 }
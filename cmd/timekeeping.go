@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+	"time"
+)
+
+// The NTP clients that setup knows how to run. The service is what has to be active for the clock to stay synced.
+var ntpServices = map[string]string{
+	"timesyncd": "systemd-timesyncd",
+	"chrony":    "chrony",
+}
+
+// Makes sure a timezone is one that both snakeplant and the server's tzdata will know about, and returns it.
+func parseTimezone(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' is not a timezone. Use a name from 'timedatectl list-timezones', like 'UTC' or 'America/New_York'.", name))
+	}
+	return loc
+}
+
+func timedatectlValue(client *simplessh.Client, property string) string {
+	out, err := client.Exec(fmt.Sprintf("timedatectl show -p %v --value", property))
+	AssertNoErr(err, fmt.Sprintf("Could not get '%v' from timedatectl.", property))
+	return strings.TrimSpace(string(out))
+}
+
+func timezoneStep(client *simplessh.Client, timezone string) Step {
+	return Step{
+		Name:        "set-timezone",
+		Description: "Setting the timezone",
+		Inputs:      []string{timezone},
+		Check: func() bool {
+			return timedatectlValue(client, "Timezone") != timezone
+		},
+		Apply: func() {
+			PrintSubStepInformation(fmt.Sprintf("%vThe timezone is '%v', and should be '%v'.", LINE_PADDING, timedatectlValue(client, "Timezone"), timezone))
+			SSHCommand(client, fmt.Sprintf("timedatectl set-timezone %v", timezone))
+		},
+	}
+}
+
+// The two conflict with each other, so installing one takes the other one out.
+func ntpPackage(target platform, ntp string) aptPackage {
+	return aptPackage{name: target.packageName(ntpServices[ntp])}
+}
+
+func ntpSteps(client *simplessh.Client, ntp string) []Step {
+	service := ntpServices[ntp]
+
+	return []Step{
+		{
+			Name:        "enable-ntp",
+			Description: fmt.Sprintf("Turning on %v", service),
+			DependsOn:   []string{"install-packages"},
+			Inputs:      []string{service},
+			Check: func() bool {
+				_, err := client.Exec(fmt.Sprintf("systemctl is-active %v", service))
+				AssertAnyErrWasDueToNonZeroExitCode(err, fmt.Sprintf("Could not check if %v is running.", service))
+				// timedatectl's 'NTP' setting is only about timesyncd.
+				return err != nil || (ntp == "timesyncd" && timedatectlValue(client, "NTP") != "yes")
+			},
+			Apply: func() {
+				PrintSubStepInformation(fmt.Sprintf("%v%v is '%v', and should be 'active'.", LINE_PADDING, service, activeState(client, service)))
+				SSHCommand(client, fmt.Sprintf("systemctl enable --now %v", service))
+				if ntp == "timesyncd" {
+					SSHCommand(client, "timedatectl set-ntp true")
+				}
+			},
+		},
+		{
+			Name:        "check-clock-synced",
+			Description: "Checking the clock is synced",
+			DependsOn:   []string{"enable-ntp"},
+			AlwaysRun:   true,
+			Apply: func() {
+				// Right after NTP is turned on, it can take a little while to reach a server.
+				for i := 0; i < 15; i++ {
+					if timedatectlValue(client, "NTPSynchronized") == "yes" {
+						PrintSubStepInformation(fmt.Sprintf("%vThe clock is synced.", LINE_PADDING))
+						return
+					}
+					time.Sleep(2 * time.Second)
+				}
+				// Not worth stopping setup over, since the clock is usually close enough until it does sync.
+				color.Yellow("%vThe clock isn't synced yet. 'timedatectl timesync-status' (or 'chronyc tracking' for chrony) shows what it's waiting on.", LINE_PADDING)
+			},
+		},
+	}
+}
+
+func activeState(client *simplessh.Client, unit string) string {
+	out, _ := client.Exec(fmt.Sprintf("systemctl is-active %v", unit))
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/sfreiberg/simplessh"
+	"strings"
+)
+
+// snakeplant's own apt.conf.d file. Files there are read in order, so anything set here wins over the defaults in
+// 50unattended-upgrades without having to edit it. Some good context about how these files work:
+// https://askubuntu.com/a/878600
+const unattendedUpgradesConfPath = "/etc/apt/apt.conf.d/52snakeplant"
+
+var mailReportValues = []string{"always", "only-on-error", "on-change"}
+
+type unattendedUpgradesOptions struct {
+	// Package names, or regular expressions that match the start of them. These are never upgraded automatically.
+	blocklist []string
+	// Origins-Pattern entries, like 'origin=Ubuntu,archive=${distro_codename}-security'. Empty keeps the distribution's
+	// defaults.
+	origins                  []string
+	removeUnusedDependencies bool
+	// Empty doesn't send mail.
+	mail       string
+	mailReport string
+	syslog     bool
+}
+
+func newUnattendedUpgradesOptions() unattendedUpgradesOptions {
+	options := unattendedUpgradesOptions{
+		blocklist:                *Flags.Setup.UpgradeBlocklist,
+		origins:                  *Flags.Setup.UpgradeOrigins,
+		removeUnusedDependencies: *Flags.Setup.RemoveUnusedDependencies,
+		mail:                     *Flags.Setup.UpgradeMail,
+		mailReport:               *Flags.Setup.UpgradeMailReport,
+		syslog:                   *Flags.Setup.UpgradeSyslog,
+	}
+
+	if !containsString(mailReportValues, options.mailReport) {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' isn't a mail report setting. It has to be one of: %v.", options.mailReport, strings.Join(mailReportValues, ", ")))
+	}
+
+	// apt.conf has no way to escape a quote inside a value.
+	values := append([]string{options.mail}, options.blocklist...)
+	for _, value := range append(values, options.origins...) {
+		if strings.ContainsAny(value, "\"\n") {
+			PrintMessageAndQuit(fmt.Sprintf("'%v' can't have a double quote or a new line in it.", value))
+		}
+	}
+	return options
+}
+
+// One setting in apt.conf. A list can have any number of values, including none, and everything else has exactly one.
+type aptSetting struct {
+	key    string
+	values []string
+	list   bool
+}
+
+func aptValue(key string, value interface{}) aptSetting {
+	return aptSetting{key: key, values: []string{fmt.Sprint(value)}}
+}
+
+func aptList(key string, values []string) aptSetting {
+	return aptSetting{key: key, values: values, list: true}
+}
+
+// Every setting, in the order it's written. conf writes these, and validate checks 'apt-config dump' reads them back
+// the same way.
+func (o unattendedUpgradesOptions) settings() []aptSetting {
+	settings := []aptSetting{
+		// Rebooting is left to snakeplant-reboot.timer, since unattended-upgrades can't be told which days it's allowed on.
+		aptValue("Unattended-Upgrade::Automatic-Reboot", false),
+		aptValue("Unattended-Upgrade::Remove-Unused-Dependencies", o.removeUnusedDependencies),
+		aptValue("Unattended-Upgrade::Remove-Unused-Kernel-Packages", o.removeUnusedDependencies),
+		aptValue("Unattended-Upgrade::SyslogEnable", o.syslog),
+		aptValue("Unattended-Upgrade::Verbose", true),
+		aptList("Unattended-Upgrade::Package-Blacklist", o.blocklist),
+	}
+	if len(o.origins) > 0 {
+		settings = append(settings, aptList("Unattended-Upgrade::Origins-Pattern", o.origins))
+	}
+	if o.mail != "" {
+		settings = append(settings,
+			aptValue("Unattended-Upgrade::Mail", o.mail),
+			aptValue("Unattended-Upgrade::MailReport", o.mailReport),
+		)
+	}
+	return settings
+}
+
+func (s aptSetting) String() string {
+	if !s.list {
+		return fmt.Sprintf(`%v "%v";`, s.key, s.values[0])
+	}
+
+	// Lists in apt.conf are added to by every file that mentions them, so without '#clear' the defaults in
+	// 50unattended-upgrades would still be in there.
+	lines := []string{fmt.Sprintf("#clear %v;", s.key), fmt.Sprintf("%v {", s.key)}
+	for _, value := range s.values {
+		lines = append(lines, fmt.Sprintf("\t\"%v\";", value))
+	}
+	return strings.Join(append(lines, "};"), "\n")
+}
+
+func (o unattendedUpgradesOptions) conf() string {
+	lines := []string{"// Managed by snakeplant. Changes made by hand will be overwritten the next time 'snakeplant setup' runs."}
+	for _, setting := range o.settings() {
+		lines = append(lines, setting.String())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Turns lines like 'Foo::Bar "baz";' into Foo::Bar -> [baz]. List entries are printed as 'Foo::List:: "value";', and
+// go into Foo::List.
+func parseAptConfigDump(dump string) map[string][]string {
+	values := map[string][]string{}
+	for _, line := range strings.Split(dump, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSuffix(value, ";"), `"`), `"`)
+
+		if strings.HasSuffix(key, "::") {
+			key = strings.TrimSuffix(key, "::")
+			values[key] = append(values[key], value)
+		} else if _, ok := values[key]; !ok {
+			// A list's own line has an empty value before its entries.
+			values[key] = nil
+			if value != "" {
+				values[key] = []string{value}
+			}
+		}
+	}
+	return values
+}
+
+// Has apt read the file at stagedPath the way it was meant to be read? apt-config loads the configuration the server
+// has now, and then the staged file on top of it, the same way it would be once it's in apt.conf.d.
+func (o unattendedUpgradesOptions) validate(client *simplessh.Client, stagedPath string) {
+	out, err := client.Exec(fmt.Sprintf("apt-config -c %v dump", stagedPath))
+	if err != nil {
+		PrintMessageAndQuit(fmt.Sprintf("apt couldn't read the new automatic security update settings:\n%v%v", LINE_PADDING, strings.TrimSpace(string(out))))
+	}
+
+	dumped := parseAptConfigDump(string(out))
+	var wrong []string
+	for _, setting := range o.settings() {
+		got := dumped[setting.key]
+		if strings.Join(got, "\x00") != strings.Join(setting.values, "\x00") {
+			wrong = append(wrong, fmt.Sprintf("%v is %q, but should be %q", setting.key, got, setting.values))
+		}
+	}
+	if len(wrong) > 0 {
+		PrintMessageAndQuit(fmt.Sprintf("apt doesn't read the new automatic security update settings the way snakeplant wrote them:\n%v%v", LINE_PADDING, strings.Join(wrong, "\n"+LINE_PADDING)))
+	}
+	PrintSubStepInformation(fmt.Sprintf("%v'apt-config dump' shows every setting the way it was written.", LINE_PADDING))
+}
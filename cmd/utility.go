@@ -1,28 +1,149 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/fatih/color"
 	"github.com/sfreiberg/simplessh"
 	"golang.org/x/crypto/ssh"
 	"os"
 	"strconv"
+	"strings"
 )
 
 var Flags = struct {
 	Root struct {
 	}
 	Setup struct {
-		Port       *int
-		Host       *string
-		Key        *string
-		RebootTime *string
+		Port                     *int
+		Host                     *string
+		Key                      *string
+		RebootTime               *string
+		RebootDays               *[]string
+		RebootWithUsers          *bool
+		UpgradeBlocklist         *[]string
+		UpgradeOrigins           *[]string
+		RemoveUnusedDependencies *bool
+		UpgradeMail              *string
+		UpgradeMailReport        *string
+		UpgradeSyslog            *bool
+		Timezone                 *string
+		NTP                      *string
+		Hostname                 *string
+		SwapSize                 *string
+		Swappiness               *int
+		DockerEngine             *string
+		DockerVersion            *string
+		DockerLogMaxSize         *string
+		DockerLogMaxFiles        *int
+		PackVersion              *string
+		PackBuilder              *string
+		PackTrustedBuilders      *[]string
+		TCPPorts                 *string
+		UDPPorts                 *string
+		SSHFrom                  *[]string
+		FirewallRollbackSeconds  *int
+		FirewallBackend          *string
+		AllowSSHPasswords        *bool
+		SSHProtection            *string
+		SSHBanTime               *string
+		SSHFindTime              *string
+		SSHMaxRetries            *int
+		SSHRateLimit             *int
+		DisableSuites            *[]string
+		EnableSuites             *[]string
+		DisableComponents        *[]string
+		EnableComponents         *[]string
+		AptMirror                *string
+		AptProxy                 *string
+		Packages                 *[]string
+		ArtifactCache            *string
+		DpkgLockTimeout          *int
+		Plan                     *bool
+		Only                     *[]string
+		Skip                     *[]string
+		Force                    *bool
+	}
+	Firewall struct {
+		Port            *int
+		Host            *string
+		Key             *string
+		RollbackSeconds *int
+		AllowFrom       *[]string
+		DenyFrom        *[]string
+	}
+	Bans struct {
+		Port *int
+		Host *string
+		Key  *string
 	}
 	Upload struct {
-		Port       *int
-		Host       *string
-		Key        *string
-		RebootTime *string
+		Port        *int
+		Host        *string
+		Key         *string
+		RebootTime  *string
+		SigningKey  *string
+		Encrypt     *bool
+		Recipients  *[]string
+		MaxSize     *string
+		MaxFileSize *string
+		Tags        *[]string
+		Labels      *[]string
+	}
+	RebootWindow struct {
+		Port *int
+		Host *string
+		Key  *string
+	}
+	Pack struct {
+		Port          *int
+		Host          *string
+		Key           *string
+		Version       *string
+		ArtifactCache *string
+	}
+	Cache struct {
+		Dir         *string
+		PackVersion *string
+		PackArch    *string
+		From        *string
+		Sha256Sums  *string
+	}
+	List struct {
+		Port *int
+		Host *string
+		Key  *string
+	}
+	Tag struct {
+		Port *int
+		Host *string
+		Key  *string
+	}
+	Diff struct {
+		Port *int
+		Host *string
+		Key  *string
+	}
+	Delete struct {
+		Port *int
+		Host *string
+		Key  *string
+	}
+	Download struct {
+		Port   *int
+		Host   *string
+		Key    *string
+		Output *string
+	}
+	Verify struct {
+		Port *int
+		Host *string
+		Key  *string
+	}
+	Signers struct {
+		Port *int
+		Host *string
+		Key  *string
 	}
 }{}
 
@@ -53,21 +174,17 @@ func step(counter *int, beginDesc string, action func()) {
 	*counter++
 }
 
-func printDiffHeader() {
-	printSubStepInformation(fmt.Sprintf("%vDiff of changes. Left of the '|' is before the file was changed, right of the '|' is after.", LINE_PADDING))
-}
-
-func printSubStepInformation(message string) {
+func PrintSubStepInformation(message string) {
 	color.Cyan(message)
 }
 func AssertNoErr(err error, message string) {
 	if err != nil {
 		color.Red("%v%v\n", LINE_PADDING, err)
-		printMessageAndQuit(message)
+		PrintMessageAndQuit(message)
 	}
 }
 
-func printMessageAndQuit(message string) {
+func PrintMessageAndQuit(message string) {
 	color.HiRed("%v%v", LINE_PADDING, message)
 	os.Exit(1)
 }
@@ -90,7 +207,7 @@ func (f *LineHolder) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func sshCommand(client *simplessh.Client, command string) {
+func SSHCommand(client *simplessh.Client, command string) {
 	session, err := client.SSHClient.NewSession()
 	AssertNoErr(err, "Could not open session for running an ssh command.")
 
@@ -153,23 +270,7 @@ func curlCommand(client *simplessh.Client, command string) {
 	}
 }
 
-func installPackage(counter *int, client *simplessh.Client, packageName string) {
-	step(counter, fmt.Sprintf("Installing %v", packageName), func() {
-		// We don't want to run install on subsequent runs as that could cause the package to update and cause a broken system.
-		// See https://serverfault.com/a/670688
-		_, err := client.Exec(fmt.Sprintf("DEBIAN_FRONTEND=noninteractive dpkg -l %v", packageName))
-		assertAnyErrWasDueToNonZeroExitCode(err, fmt.Sprintf("%v'dpkg' listing was interrupted.", LINE_PADDING))
-
-		if err == nil {
-			printSubStepInformation(fmt.Sprintf("%v'%v' package was previously installed.\n", LINE_PADDING, packageName))
-			return
-		}
-
-		sshCommand(client, fmt.Sprintf("apt-get install %v -y", packageName))
-	})
-}
-
-func assertAnyErrWasDueToNonZeroExitCode(err error, message string) {
+func AssertAnyErrWasDueToNonZeroExitCode(err error, message string) {
 	if exitErr, ok := err.(*ssh.ExitError); ok {
 		// I spent an hour looking into this because I wasn't sure if it was right. The following is correct (probably ¯\_(ツ)_/¯),
 		// but the API for `ExitError` is EXTREMELY esoteric.
@@ -188,14 +289,14 @@ func assertAnyErrWasDueToNonZeroExitCode(err error, message string) {
 
 func safeIdempotentCopyFile(client *simplessh.Client, sourceFilePath, targetFilePath string) {
 	_, err := client.Exec(fmt.Sprintf("[ -f \"%v\" ] && [ -f \"%v.finished\" ]", targetFilePath, targetFilePath))
-	assertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking if target was already copied over successfully.")
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking if target was already copied over successfully.")
 
 	if err == nil {
 		return
 	}
 
 	_, err = client.Exec(fmt.Sprintf("[ -f \"%v\" ] && ! [ -f \"%v.finished\" ]", targetFilePath, targetFilePath))
-	assertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for corrupted target file.")
+	AssertAnyErrWasDueToNonZeroExitCode(err, "Interrupted while checking for corrupted target file.")
 
 	if err != nil {
 		// The copy was interrupted before it finished the last time it was run. Remove everything and start over.
@@ -216,3 +317,41 @@ func safeIdempotentCopyFile(client *simplessh.Client, sourceFilePath, targetFile
 	_, err = client.Exec(fmt.Sprintf("touch \"%v.finished\"", targetFilePath))
 	AssertNoErr(err, "Unable to create .finished file.")
 }
+
+// Writes to a temp file next to the target and then moves it into place, so a dropped connection can never leave a
+// half written file behind. The temp file starts out root-only so secrets are never readable, even for a moment.
+func WriteRemoteFile(client *simplessh.Client, filePath string, content []byte, mode os.FileMode) {
+	session, err := client.SSHClient.NewSession()
+	AssertNoErr(err, "Could not open session for writing a remote file.")
+	defer session.Close()
+
+	session.Stdin = bytes.NewReader(content)
+
+	tempFile := fmt.Sprintf("%v.snakeplant-tmp", filePath)
+	output, err := session.CombinedOutput(fmt.Sprintf("umask 077 && cat > \"%v\" && chmod %o \"%v\" && mv \"%v\" \"%v\"", tempFile, mode, tempFile, tempFile, filePath))
+	if err != nil {
+		color.Red("%v%v\n", LINE_PADDING, string(output))
+	}
+	AssertNoErr(err, fmt.Sprintf("Unable to write %v.", filePath))
+}
+
+// Takes things like '500MB', '2G' or '1024', and returns bytes. Units are powers of 1024.
+func ParseSize(size, flagName string) int64 {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	size = strings.TrimSuffix(strings.TrimSuffix(size, "B"), "I")
+
+	multiplier := int64(1)
+	for i, unit := range "KMGT" {
+		if strings.HasSuffix(size, string(unit)) {
+			multiplier = int64(1) << (10 * (i + 1))
+			size = strings.TrimSuffix(size, string(unit))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(size), 64)
+	if err != nil || value < 0 {
+		PrintMessageAndQuit(fmt.Sprintf("'%v' must be a size like '500MB' or '2GB'.", flagName))
+	}
+	return int64(value * float64(multiplier))
+}
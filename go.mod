@@ -3,9 +3,11 @@ module github.com/mavenraven/snakeplant
 go 1.18
 
 require (
+	filippo.io/age v1.0.0
 	github.com/fatih/color v1.14.1
 	github.com/sfreiberg/simplessh v0.0.0-20220719182921-185eafd40485
 	github.com/spf13/cobra v1.6.1
+	golang.org/x/crypto v0.3.0
 )
 
 require (
@@ -16,6 +18,5 @@ require (
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/pkg/sftp v1.13.4 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/crypto v0.3.0 // indirect
 	golang.org/x/sys v0.3.0 // indirect
 )